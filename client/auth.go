@@ -0,0 +1,56 @@
+package cosclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Authenticator adds credentials to each request sent to COS. The default
+// uses IAM bearer tokens from the client's APIKey, *Signer uses HMAC keys.
+type Authenticator interface {
+	// Authenticate is called just before 'req' is sent, once per attempt.
+	// 'body' is what req.Body reads from (nil if there's none). If it's
+	// an io.Seeker it can be read as long as it's rewound afterwards.
+	Authenticate(ctx context.Context, req *http.Request, body io.Reader) error
+}
+
+// WithAuthenticator makes the client use 'auth' rather than IAM bearer
+// tokens or, if only HMAC keys were given, SigV4.
+func WithAuthenticator(auth Authenticator) Option {
+	return func(opts *clientOptions) error {
+		if auth == nil {
+			return fmt.Errorf("Missing authenticator")
+		}
+		opts.auth = auth
+		return nil
+	}
+}
+
+func (client *COSClient) authenticator() Authenticator {
+	if client.Auth != nil {
+		return client.Auth
+	}
+	return bearerAuth{client}
+}
+
+// bearerAuth sends the client's IAM token, refreshing it first if needed.
+type bearerAuth struct {
+	client *COSClient
+}
+
+func (auth bearerAuth) Authenticate(ctx context.Context, req *http.Request, body io.Reader) error {
+	// Refresh if needed
+	token, err := auth.client.GetToken(ctx)
+	if err != nil {
+		return fmt.Errorf("Error getting IAM token: %w", err)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+	if len(token) > 8 {
+		token = token[:8]
+	}
+	Debug(2, "AUTH: Bearer %s...\n", token)
+	return nil
+}
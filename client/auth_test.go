@@ -0,0 +1,68 @@
+package cosclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuthenticatorChoice(t *testing.T) {
+	tests := []struct {
+		name   string
+		client func() (*COSClient, error)
+		auth   string // Prefix of the Authorization header
+	}{
+		{"token", func() (*COSClient, error) {
+			return NewClient("", testInstanceID, WithToken("my-token"))
+		}, "Bearer my-token"},
+		{"token credentials", func() (*COSClient, error) {
+			return NewClientWithCredentials(context.Background(),
+				&StaticProvider{Credentials{Token: "my-token"}}, testInstanceID)
+		}, "Bearer my-token"},
+		{"hmac", func() (*COSClient, error) {
+			return NewClient("", testInstanceID, WithHMAC("id", "secret"))
+		}, "AWS4-HMAC-SHA256 Credential=id/"},
+		{"hmac wins over a token", func() (*COSClient, error) {
+			return NewClient("", testInstanceID, WithHMAC("id", "secret"),
+				WithToken("my-token"))
+		}, "AWS4-HMAC-SHA256 Credential=id/"},
+		{"apikey wins over hmac", func() (*COSClient, error) {
+			client, err := NewClient("apikey", testInstanceID,
+				WithHMAC("id", "secret"))
+			if err == nil {
+				client.Token = "iam-token"
+				client.Expires = time.Now().Add(time.Hour)
+			}
+			return client, err
+		}, "Bearer iam-token"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := ""
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				auth = r.Header.Get("Authorization")
+			}))
+			defer srv.Close()
+
+			client, err := test.client()
+			if err != nil {
+				t.Fatalf("creating client: %s", err)
+			}
+			if _, err = client.doHTTP(context.Background(), "GET",
+				srv.URL+"/b/k", nil, 1, nil); err != nil {
+				t.Fatalf("GET: %s", err)
+			}
+			if !strings.HasPrefix(auth, test.auth) {
+				t.Errorf("Authorization = %q, want %q...", auth, test.auth)
+			}
+		})
+	}
+
+	if _, err := NewClient("", testInstanceID); err == nil {
+		t.Errorf("NewClient() with no credentials didn't fail")
+	}
+}
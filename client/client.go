@@ -2,24 +2,26 @@ package cosclient
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
 var Verbose = 1
-var refreshTime = time.Minute * 5
 
 func Debug(level int, format string, args ...interface{}) {
 	if level > Verbose {
@@ -29,26 +31,54 @@ func Debug(level int, format string, args ...interface{}) {
 }
 
 type COSClient struct {
-	APIKey      string
-	IAMEndpoint string
-	ID          string
+	APIKey         string
+	TrustedProfile *TrustedProfile // Used instead of APIKey if set
+	IAMEndpoint    string
+	ID             string
+
+	// The IAM (OAuth) client to get tokens as, see WithIAMClient
+	IAMClientID     string
+	IAMClientSecret string
 
+	// The IAM token, see GetToken. Only touch these while holding
+	// RefreshMutex.
 	Token        string
 	Expires      time.Time
 	RefreshMutex sync.Mutex
+	tokens       tokenManager
 
 	Endpoints map[string]string // BucketName -> URL
+
+	// HMAC credentials, needed for presigned URLs
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string // For SigV4, defaults to DefaultRegion
+
+	// Auth adds the credentials to each request, nil means IAM bearer
+	// tokens, see GetToken
+	Auth Authenticator
+
+	// HTTPClient is used for all requests, nil means a shared default
+	HTTPClient *http.Client
+
+	// RetryPolicy for transient failures, nil means DefaultRetryPolicy
+	RetryPolicy *RetryPolicy
 }
 
 type BucketMetadata struct {
 	Name                 string
 	Service_Instance_ID  string
-	Created              string `json:"time_updated"`
+	Created              string `json:"time_created"`
 	Updated              string `json:"time_updated"`
 	Objects              int    `json:"object_count"`
 	Bytes                int    `json:"bytes_used"`
 	CRN                  string
 	Service_Instance_CRN string
+
+	// Key Protect / HPCS, these come from a HEAD of the bucket and are
+	// empty if it fails, see GetBucketKeyProtect
+	KeyProtectEnabled    bool   `json:"-"`
+	KeyProtectRootKeyCRN string `json:"-"`
 }
 
 type BucketListResponse struct {
@@ -78,11 +108,18 @@ type BucketList struct {
 	}
 }
 
+type Owner struct {
+	ID          string
+	DisplayName string
+}
+
 type ObjectMetadata struct {
 	Key          string
 	LastModified string
 	ETag         string
-	Size         int
+	Size         int64
+	StorageClass string
+	Owner        *Owner // Only if asked for
 }
 
 type ObjectList []ObjectMetadata
@@ -90,30 +127,38 @@ type ObjectList []ObjectMetadata
 type ObjectListResponse struct {
 	Name                  string
 	Prefix                string
+	StartAfter            string
+	ContinuationToken     string
 	NextContinuationToken string
 	KeyCount              int
 	MaxKeys               int
 	Delimiter             string
+	EncodingType          string
 	IsTruncated           bool
-	Contents              []struct {
-		Key          string
-		LastModified string
-		ETag         string
-		Size         int
-		Owner        struct {
-			ID          string
-			DisplayName string
-		}
-		StorageClass string
+	Contents              []ObjectMetadata
+	CommonPrefixes        []struct {
+		Prefix string
 	}
 }
 
 // https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-curl
 // https://cloud.ibm.com/docs/services/cloud-object-storage?topic=cloud-object-storage-compatibility-api-bucket-operations#compatibility-api-new-bucket
 
-func NewClient(apikey, id string) (*COSClient, error) {
-	if apikey == "" {
-		return nil, fmt.Errorf("Missing APIKey")
+// NewClient returns a client that authenticates with IAM using 'apikey'.
+// 'apikey' can be "" if a token (see WithToken) or HMAC keys (see WithHMAC)
+// are given instead. With only HMAC keys every request is signed with
+// SigV4.
+func NewClient(apikey, id string, opts ...Option) (*COSClient, error) {
+	options := clientOptions{}
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return nil, err
+		}
+	}
+
+	if apikey == "" && options.accessKeyID == "" && options.auth == nil &&
+		options.trustedProfile == nil && options.token == "" {
+		return nil, fmt.Errorf("Missing APIKey, token or HMAC credentials")
 	}
 
 	if id == "" {
@@ -135,6 +180,24 @@ func NewClient(apikey, id string) (*COSClient, error) {
 		Expires: time.Time{},
 	}
 
+	httpClient, err := options.buildHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	client.HTTPClient = httpClient
+	client.RetryPolicy = options.retryPolicy
+	client.AccessKeyID = options.accessKeyID
+	client.SecretAccessKey = options.secretAccessKey
+	client.Region = options.region
+	client.TrustedProfile = options.trustedProfile
+	client.Auth = options.auth
+	client.Token = options.token
+	client.IAMClientID = options.iamClientID
+	client.IAMClientSecret = options.iamClientSecret
+	if client.Auth == nil && !client.canRefresh() && client.AccessKeyID != "" {
+		client.Auth = client.signer()
+	}
+
 	// if err := client.Refresh(); err != nil {
 	// return nil, err
 	// }
@@ -142,90 +205,208 @@ func NewClient(apikey, id string) (*COSClient, error) {
 	return client, nil
 }
 
-func (client *COSClient) Refresh() error {
-	client.RefreshMutex.Lock()
-	defer client.RefreshMutex.Unlock()
+// postIAM sends a token request to IAM, retrying transient failures, and
+// returns the response body.
+func (client *COSClient) postIAM(ctx context.Context, bodyStr string, headers map[string]string) ([]byte, error) {
+	policy := client.retryPolicy()
 
-	if time.Now().Add(refreshTime).Before(client.Expires) {
-		return nil
-	}
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "POST", client.IAMEndpoint,
+			strings.NewReader(bodyStr))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating HTTP client: %w", err)
+		}
+		req.Header.Add("Accept", "application/json")
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		for k, v := range headers {
+			req.Header.Add(k, v)
+		}
 
-	log.Printf("Refreshing COS token")
-	bodyStr := "apikey=" + url.PathEscape(client.APIKey) + "&" +
-		"response_type=cloud_iam&" +
-		"grant_type=urn:ibm:params:oauth:grant-type:apikey"
+		event := RetryEvent{
+			Method:  "POST",
+			Path:    client.IAMEndpoint,
+			Attempt: attempt,
+		}
 
-	req, err := http.NewRequest("POST", client.IAMEndpoint,
-		strings.NewReader(bodyStr))
-	if err != nil {
-		return fmt.Errorf("Error creating HTTP client: %s", err)
-	}
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Close = true
+		res, err := client.httpClient().Do(req)
+		if err != nil {
+			err = fmt.Errorf("Error getting IAM token: %w", err)
+			if ctx.Err() != nil || attempt >= policy.MaxAttempts {
+				return nil, err
+			}
+			event.Err = err
+			event.Delay = policy.backoff(attempt, "")
+		} else {
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Error http response: %w", err)
+			}
+			if res.StatusCode/100 == 2 {
+				return body, nil
+			}
+			iamErr := newIAMError(res, body)
+			if attempt >= policy.MaxAttempts ||
+				!isRetryableStatus(res.StatusCode) {
+				return nil, iamErr
+			}
+			event.StatusCode = res.StatusCode
+			event.Err = iamErr
+			event.Delay = policy.backoff(attempt, res.Header.Get("Retry-After"))
+		}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		if err := policy.wait(ctx, event); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	httpClient := &http.Client{Transport: tr}
-	res, err := httpClient.Do(req)
+func (client *COSClient) doHTTP(ctx context.Context, method string, path string, body []byte, num int, headers map[string]string) ([]byte, error) {
+	Debug(2, "BODY: %s\n", string(body))
+
+	res, err := client.doStream(ctx, method, path,
+		bytes.NewReader(body), int64(len(body)), num, headers)
 	if err != nil {
-		return fmt.Errorf("Error getting IAM token: %s", err)
+		return nil, err
 	}
 
-	defer httpClient.CloseIdleConnections()
 	defer res.Body.Close()
-	body, err := ioutil.ReadAll(res.Body)
+	body, err = ioutil.ReadAll(res.Body)
 	if err != nil {
-		return fmt.Errorf("Error http response: %s", err)
+		Debug(2, "ERR: %s\n", err)
+		return nil, fmt.Errorf("Error reading response(%s): %w", path, err)
 	}
+	return body, nil
+}
 
-	data := struct {
-		Access_token  string
-		Expiration    int64
-		expires_in    int
-		Refresh_token string
-		Scope         string
-		Token_type    string
-		// or...
-		ErrorMessage string
-	}{}
-
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return fmt.Errorf("Error parsing response: %s\n%s",
-			err, string(body))
+// doStream sends the request with 'body' streamed as-is to the server.
+// 'size' is used as the Content-Length, -1 means unknown, in which case
+// chunked transfer encoding is used. On success the caller owns, and must
+// close, the response body.
+// Transient failures are retried per the client's RetryPolicy, but only
+// if the request is idempotent and 'body' can be rewound (is an
+// io.Seeker). A 401 causes a token refresh and one more try.
+func (client *COSClient) doStream(ctx context.Context, method string, path string, body io.Reader, size int64, num int, headers map[string]string) (*http.Response, error) {
+	policy := client.retryPolicyFor(ctx)
+
+	if size == 0 {
+		body = nil
+	}
+
+	// Remember where the body starts so we can rewind it for retries
+	seeker, canRewind := body.(io.Seeker)
+	offset := int64(0)
+	if body == nil {
+		canRewind = true
+	} else if canRewind {
+		var err error
+		if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			canRewind = false
+		}
 	}
+	canReplay := canRewind && isIdempotent(ctx, method)
 
-	if data.ErrorMessage != "" {
-		return fmt.Errorf(data.ErrorMessage)
-	}
+	refreshed := false
+	sent := false
+	for attempt := 1; ; attempt++ {
+		if sent && body != nil {
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return nil, fmt.Errorf("Error rewinding body: %w", err)
+			}
+		}
+
+		sent = true
+		res, err := client.sendRequest(ctx, method, path, body, size, num,
+			headers)
+		if err != nil {
+			Debug(2, "ERR: %s\n", err)
+			if authErr, ok := err.(*authError); ok {
+				// Getting the token already had its own retries
+				return nil, authErr.err
+			}
+			if !canReplay || ctx.Err() != nil || attempt >= policy.MaxAttempts {
+				return nil, err
+			}
+			event := RetryEvent{
+				Method:  method,
+				Path:    path,
+				Attempt: attempt,
+				Err:     err,
+				Delay:   policy.backoff(attempt, ""),
+			}
+			if err := policy.wait(ctx, event); err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-	client.Token = data.Access_token
-	client.Expires = time.Unix(data.Expiration, 0)
+		if res.StatusCode/100 == 2 {
+			return res, nil
+		}
 
-	return nil
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		cosErr := newError(res, buf)
+		Debug(2, "ERR: %s\n", cosErr)
+
+		// A 401 means the request wasn't run, so even a POST can be sent
+		// again as long as its body can be rewound
+		if res.StatusCode == http.StatusUnauthorized && !refreshed &&
+			canRewind && client.canRefresh() {
+			// Token may have been revoked or expired early, get a new one
+			refreshed = true
+			client.expireToken()
+			attempt--
+			continue
+		}
+
+		if !canReplay || attempt >= policy.MaxAttempts || !cosErr.retryable() {
+			return nil, cosErr
+		}
+
+		event := RetryEvent{
+			Method:     method,
+			Path:       path,
+			Attempt:    attempt,
+			StatusCode: res.StatusCode,
+			Err:        cosErr,
+			Delay:      policy.backoff(attempt, res.Header.Get("Retry-After")),
+		}
+		if err := policy.wait(ctx, event); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authError is how sendRequest tells doStream not to retry a request that
+// couldn't be authenticated.
+type authError struct {
+	err error
 }
 
-func (client *COSClient) doHTTP(method string, path string, body []byte, num int, headers map[string]string) ([]byte, error) {
+func (e *authError) Error() string { return e.err.Error() }
+func (e *authError) Unwrap() error { return e.err }
 
-	// Refresh if needed
-	client.Refresh()
+// sendRequest does a single attempt at sending the request.
+func (client *COSClient) sendRequest(ctx context.Context, method string, path string, body io.Reader, size int64, num int, headers map[string]string) (*http.Response, error) {
 
-	reader := bytes.NewReader(body)
-	req, err := http.NewRequest(method, path, reader)
+	// Don't let net/http close the caller's reader, e.g. an *os.File
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = ioutil.NopCloser(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("Creating HTTP client: %s", err)
+		return nil, fmt.Errorf("Creating HTTP client: %w", err)
+	}
+	if body != nil {
+		req.ContentLength = size
 	}
 
 	Debug(2, "PATH: %s\n", path)
 	Debug(2, "METHOD: %s\n", method)
-	Debug(2, "BODY: %s\n", string(body))
-
-	req.Header.Add("Authorization", "Bearer "+client.Token)
-	Debug(2, "AUTH: %s\n", req.Header.Get("Authorization")[:15])
-	req.Close = true
+	Debug(2, "SIZE: %d\n", size)
 
 	if num > 1 {
 		req.Header.Add("ibm-service-instance-id", client.ID)
@@ -234,43 +415,53 @@ func (client *COSClient) doHTTP(method string, path string, body []byte, num int
 
 	for k, v := range headers {
 		req.Header.Add(k, v)
+		if strings.HasSuffix(strings.ToLower(k), "-customer-key") {
+			v = "<hidden>" // SSE-C keys
+		}
 		Debug(2, "HEADER: %s: %s\n", k, v)
 	}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	// Last, since SigV4 signs the headers
+	if err := client.authenticator().Authenticate(ctx, req, body); err != nil {
+		return nil, &authError{err}
 	}
 
-	cli := &http.Client{Transport: tr}
-	res, err := cli.Do(req)
-	if err != nil {
-		Debug(2, "ERR: %s\n", err)
-		return nil, fmt.Errorf("%s", err)
-	}
+	return client.httpClient().Do(req)
+}
 
-	defer cli.CloseIdleConnections()
-	defer res.Body.Close()
-	body, err = ioutil.ReadAll(res.Body)
-	if err != nil {
-		Debug(2, "ERR: %s\n", err)
-		return nil, fmt.Errorf("%s", err)
-	}
+func (client *COSClient) CreateBucket(name, daType, reg string) error {
+	return client.CreateBucketWithContext(context.Background(), name, daType, reg)
+}
 
-	if res.StatusCode/100 != 2 {
-		err = fmt.Errorf("%s", res.Status)
-		if len(body) > 0 {
-			err = fmt.Errorf("%s: %s", err, string(body))
-		}
-		Debug(2, "ERR: %s\n", err)
-		return nil, err
+func (client *COSClient) CreateBucketWithContext(ctx context.Context, name, daType, reg string) error {
+	return client.CreateBucketWithOptions(ctx, name, daType, reg, nil)
+}
+
+// CreateBucketOptions are the optional settings for CreateBucketWithOptions.
+type CreateBucketOptions struct {
+	// KeyProtectRootKeyCRN binds the bucket to a Key Protect or Hyper
+	// Protect Crypto Services root key, it can't be changed later
+	KeyProtectRootKeyCRN string
+	KeyProtectAlgorithm  string // Defaults to AES256
+}
+
+func (opts *CreateBucketOptions) headers() map[string]string {
+	headers := map[string]string{}
+	if opts == nil || opts.KeyProtectRootKeyCRN == "" {
+		return headers
 	}
-	return body, nil
+	headers["ibm-sse-kp-customer-root-key-crn"] = opts.KeyProtectRootKeyCRN
+	headers["ibm-sse-kp-encryption-algorithm"] = opts.KeyProtectAlgorithm
+	if opts.KeyProtectAlgorithm == "" {
+		headers["ibm-sse-kp-encryption-algorithm"] = SSECustomerAlgorithmAES256
+	}
+	return headers
 }
 
-func (client *COSClient) CreateBucket(name, daType, reg string) error {
+func (client *COSClient) CreateBucketWithOptions(ctx context.Context, name, daType, reg string, opts *CreateBucketOptions) error {
 	//                   type       reg        scope      name   url
 	//                 cross-region us         public     us-geo s3.us...
-	endpoints, err := GetCOSEndpoints()
+	endpoints, err := getCOSEndpoints(ctx, client.httpClient())
 	if err != nil {
 		return err
 	}
@@ -299,7 +490,7 @@ func (client *COSClient) CreateBucket(name, daType, reg string) error {
 	for _, endpoint := range nameMap {
 		path := fmt.Sprintf("https://%s/%s", endpoint, name)
 
-		_, err := client.doHTTP("PUT", path, nil, 2, nil)
+		_, err := client.doHTTP(ctx, "PUT", path, nil, 2, opts.headers())
 		return err
 	}
 
@@ -307,9 +498,13 @@ func (client *COSClient) CreateBucket(name, daType, reg string) error {
 }
 
 func (client *COSClient) GetBucketMetadata(name string) (*BucketMetadata, error) {
+	return client.GetBucketMetadataWithContext(context.Background(), name)
+}
+
+func (client *COSClient) GetBucketMetadataWithContext(ctx context.Context, name string) (*BucketMetadata, error) {
 	// {"name":"customers","service_instance_id":"ad58e4cf-c3f4-49b8-b34a-70a15a416c58","time_created":"2020-04-26T13:36:44.663Z","time_updated":"2020-04-27T01:34:14.856Z","object_count":1847,"bytes_used":82860,"crn":"crn:v1:staging:public:cloud-object-storage:global:a/80368303fa866f52abd5c0e96e771db3:ad58e4cf-c3f4-49b8-b34a-70a15a416c58:bucket:customers","service_instance_crn":"crn:v1:staging:public:cloud-object-storage:global:a/80368303fa866f52abd5c0e96e771db3:ad58e4cf-c3f4-49b8-b34a-70a15a416c58::"}
 
-	svcURL, err := client.GetEndpointForBucket(name)
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -320,9 +515,9 @@ func (client *COSClient) GetBucketMetadata(name string) (*BucketMetadata, error)
 	}
 	path := fmt.Sprintf("https://config.cloud-object-storage.%scloud.ibm.com/v1/b/%s", test, name)
 
-	body, err := client.doHTTP("GET", path, nil, 1, nil)
+	body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
 	if err != nil {
-		return nil, fmt.Errorf("GetBucketMetadata/GET(%s): %s", path, err)
+		return nil, fmt.Errorf("GetBucketMetadata/GET(%s): %w", path, err)
 	}
 
 	res := BucketMetadata{}
@@ -331,6 +526,15 @@ func (client *COSClient) GetBucketMetadata(name string) (*BucketMetadata, error)
 		return nil, err
 	}
 
+	// Not everyone who can read the metadata can HEAD the bucket, so the
+	// Key Protect fields are just left empty if that fails
+	if kp, err := client.GetBucketKeyProtect(ctx, name); err != nil {
+		Debug(1, "Error getting Key Protect settings of %s: %s\n", name, err)
+	} else {
+		res.KeyProtectEnabled = kp.Enabled
+		res.KeyProtectRootKeyCRN = kp.RootKeyCRN
+	}
+
 	return &res, nil
 }
 
@@ -350,6 +554,14 @@ var Endpoints = (*COSEndpoints)(nil)
 var endpointsMutex = sync.Mutex{}
 
 func GetCOSEndpoints() (*COSEndpoints, error) {
+	return GetCOSEndpointsWithContext(context.Background())
+}
+
+func GetCOSEndpointsWithContext(ctx context.Context) (*COSEndpoints, error) {
+	return getCOSEndpoints(ctx, defaultHTTPClient)
+}
+
+func getCOSEndpoints(ctx context.Context, httpClient *http.Client) (*COSEndpoints, error) {
 	Debug(2, "In GetCOSEndpoints\n")
 	if Endpoints != nil {
 		return Endpoints, nil
@@ -361,33 +573,28 @@ func GetCOSEndpoints() (*COSEndpoints, error) {
 	}
 
 	path := "https://control.cloud-object-storage.cloud.ibm.com/v2/endpoints"
-	req, err := http.NewRequest("GET", path, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("Creating HTTP client: %s", err)
-	}
-
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		return nil, fmt.Errorf("Creating HTTP client: %w", err)
 	}
 
 	Debug(2, "PATH: %s\n", path)
 	Debug(2, "METHOD: GET\n")
 
-	cli := &http.Client{Transport: tr}
-	res, err := cli.Do(req)
+	res, err := httpClient.Do(req)
 	if err != nil {
 		Debug(2, "ERR: %s\n", err)
-		return nil, fmt.Errorf("%s", err)
+		return nil, fmt.Errorf("%w", err)
 	}
 
 	defer res.Body.Close()
 	buf, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading endpoints: %s", err)
+		return nil, fmt.Errorf("Error reading endpoints: %w", err)
 	}
 	err = json.Unmarshal(buf, &Endpoints)
 	if err != nil {
-		err = fmt.Errorf("Error parsing endpoints: %s", err)
+		err = fmt.Errorf("Error parsing endpoints: %w", err)
 		Debug(2, "ERR: %s\n", err)
 		return nil, err
 	}
@@ -403,6 +610,10 @@ func ToJsonString(obj interface{}) string {
 var BucketEndpointsMutex = sync.RWMutex{}
 
 func (client *COSClient) GetEndpointForBucket(name string) (string, error) {
+	return client.GetEndpointForBucketWithContext(context.Background(), name)
+}
+
+func (client *COSClient) GetEndpointForBucketWithContext(ctx context.Context, name string) (string, error) {
 	// cross:  ap-smart
 	// cross:  us-standard
 	// reg  :  eu-de-standard
@@ -430,14 +641,14 @@ func (client *COSClient) GetEndpointForBucket(name string) (string, error) {
 		}
 	}
 
-	endpoints, err := GetCOSEndpoints()
+	endpoints, err := getCOSEndpoints(ctx, client.httpClient())
 	if err != nil {
-		return "", fmt.Errorf("GetEndpointsForBucket/GetCOSEndpoint: %s", err)
+		return "", fmt.Errorf("GetEndpointsForBucket/GetCOSEndpoint: %w", err)
 	}
 
-	list, err := client.ListBuckets()
+	list, err := client.ListBucketsWithContext(ctx)
 	if err != nil {
-		return "", fmt.Errorf("GetEndpointsForBucket/ListBuckets: %s", err)
+		return "", fmt.Errorf("GetEndpointsForBucket/ListBuckets: %w", err)
 	}
 
 	for _, bucket := range list.Buckets {
@@ -480,7 +691,7 @@ func (client *COSClient) GetEndpointForBucket(name string) (string, error) {
 
 		names := endpoints.ServiceEndpoints[daType][reg]["public"]
 		Debug(2, "Svc Endpoints: %v", names)
-		for name, url := range names {
+		for _, url := range names {
 			url := "https://" + url
 
 			if client.Endpoints == nil {
@@ -495,17 +706,21 @@ func (client *COSClient) GetEndpointForBucket(name string) (string, error) {
 		return "", err
 	}
 
-	err = fmt.Errorf("Can't find bucket: %s", name)
+	err = fmt.Errorf("Can't find bucket: %s: %w", name, ErrNoSuchBucket)
 	Debug(2, "ERR: %s\n", err)
 	return "", err
 }
 
 func (client *COSClient) ListBuckets() (*BucketList, error) {
+	return client.ListBucketsWithContext(context.Background())
+}
+
+func (client *COSClient) ListBucketsWithContext(ctx context.Context) (*BucketList, error) {
 	path := fmt.Sprintf("%s?extended", "https://s3.us.cloud-object-storage.appdomain.cloud")
 
-	body, err := client.doHTTP("GET", path, nil, 2, nil)
+	body, err := client.doHTTP(ctx, "GET", path, nil, 2, nil)
 	if err != nil {
-		return nil, fmt.Errorf("ListBuckets/GET(%s): %s", path, err)
+		return nil, fmt.Errorf("ListBuckets/GET(%s): %w", path, err)
 	}
 
 	// <ListAllMyBucketsResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Owner><ID>ad58e4cf-c3f4-49b8-b34a-70a15a416c58</ID><DisplayName>ad58e4cf-c3f4-49b8-b34a-70a15a416c58</DisplayName></Owner><Buckets><Bucket><Name>coligo-test</Name><CreationDate>2020-04-22T15:45:29.201Z</CreationDate></Bucket></Buckets></ListAllMyBucketsResult>
@@ -514,7 +729,7 @@ func (client *COSClient) ListBuckets() (*BucketList, error) {
 
 	err = xml.Unmarshal(body, &buckets)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing result: %s", err)
+		return nil, fmt.Errorf("Error parsing result: %w", err)
 	}
 
 	res := BucketList{
@@ -528,41 +743,63 @@ func (client *COSClient) ListBuckets() (*BucketList, error) {
 }
 
 func (client *COSClient) DeleteBucket(name string) error {
-	svcURL, err := client.GetEndpointForBucket(name)
+	return client.DeleteBucketWithContext(context.Background(), name)
+}
+
+func (client *COSClient) DeleteBucketWithContext(ctx context.Context, name string) error {
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, name)
 	if err != nil {
 		return err
 	}
 
 	path := fmt.Sprintf("%s/%s", svcURL, name)
 
-	_, err = client.doHTTP("DELETE", path, nil, 1, nil)
+	_, err = client.doHTTP(ctx, "DELETE", path, nil, 1, nil)
 	return err
 }
 
 func (client *COSClient) GetBucketLocation(name string) (string, error) {
-	svcURL, err := client.GetEndpointForBucket(name)
+	return client.GetBucketLocationWithContext(context.Background(), name)
+}
+
+func (client *COSClient) GetBucketLocationWithContext(ctx context.Context, name string) (string, error) {
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, name)
 	if err != nil {
 		return "", err
 	}
 	path := fmt.Sprintf("%s/%s?location", svcURL, name)
 
-	body, err := client.doHTTP("GET", path, nil, 1, nil)
+	body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
 	return string(body), err
 }
 
 func (client *COSClient) DeleteBucketContents(name string) error {
-	count := int32(0)
-	var resErr error
+	return client.DeleteBucketContentsWithContext(context.Background(), name)
+}
 
-	list, err := client.ListObjects(name)
+// DeleteBucketContentsWithContext deletes all of the objects in the bucket.
+// Objects that can't be deleted, e.g. because of their retention, don't
+// stop the others from being deleted; they're returned in a
+// *DeleteObjectsError.
+func (client *COSClient) DeleteBucketContentsWithContext(ctx context.Context, name string) error {
+	list, err := client.ListObjectsWithContext(ctx, name)
 	if err != nil {
-		return fmt.Errorf("Error getting bucket contents: %s", err)
+		return fmt.Errorf("Error getting bucket contents: %w", err)
 	}
 
 	if len(list) == 0 {
 		return nil
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var resErr error
+	blocked := &DeleteObjectsError{Bucket: name}
+	sem := make(chan struct{}, 10)
+
 	start := 0
 	size := len(list)
 	end := 0
@@ -579,175 +816,749 @@ func (client *COSClient) DeleteBucketContents(name string) error {
 		}
 		start = end
 
-		for atomic.LoadInt32(&count) >= 10 {
-			time.Sleep(time.Second)
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
 		}
 
-		atomic.AddInt32(&count, 1)
-		go func(objects []string, pErr *error) {
-			defer atomic.AddInt32(&count, -1)
+		wg.Add(1)
+		go func(objects []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
 
-			err := client.DeleteObjects(name, objects)
-			if err != nil {
-				*pErr = fmt.Errorf("Error deleting bucket contents: %s", resErr)
+			err := client.DeleteObjectsWithContext(ctx, name, objects)
+			if err == nil {
+				return
 			}
-		}(objects, &resErr)
-	}
 
-	for atomic.LoadInt32(&count) > 0 {
-		time.Sleep(time.Second)
+			errMutex.Lock()
+			defer errMutex.Unlock()
+
+			// Objects that can't be deleted (e.g. retention) don't stop
+			// us, we keep going and report all of them at the end
+			delErr := (*DeleteObjectsError)(nil)
+			if errors.As(err, &delErr) {
+				blocked.Errors = append(blocked.Errors, delErr.Errors...)
+				return
+			}
+			if resErr == nil {
+				resErr = fmt.Errorf("Error deleting bucket contents: %w", err)
+			}
+			cancel()
+		}(objects)
 	}
 
+	wg.Wait()
+
+	if resErr == nil && ctx.Err() != nil {
+		resErr = fmt.Errorf("Error deleting bucket contents: %w", ctx.Err())
+	}
+	if resErr == nil && len(blocked.Errors) > 0 {
+		resErr = fmt.Errorf("Error deleting bucket contents: %w", blocked)
+	}
 	return resErr
 }
 
 func (client *COSClient) DeleteBucketAll(name string) error {
-	err := client.DeleteBucketContents(name)
+	return client.DeleteBucketAllWithContext(context.Background(), name)
+}
+
+func (client *COSClient) DeleteBucketAllWithContext(ctx context.Context, name string) error {
+	err := client.DeleteBucketContentsWithContext(ctx, name)
 	if err != nil {
 		return err
 	}
 
-	return client.DeleteBucket(name)
+	return client.DeleteBucketWithContext(ctx, name)
 }
 
 func (client *COSClient) BucketExists(name string) bool {
+	return client.BucketExistsWithContext(context.Background(), name)
+}
+
+func (client *COSClient) BucketExistsWithContext(ctx context.Context, name string) bool {
 	// https://config.cloud-object-storage.cloud.ibm.com/v1/b/
 
 	// path := "https://config.cloud-object-storage.cloud.ibm.com/v1/b/" + name
 	path := fmt.Sprintf("%s/%s", "https://s3.us.cloud-object-storage.appdomain.cloud", name)
-	_, err := client.doHTTP("HEAD", path, nil, 1, nil)
+	_, err := client.doHTTP(ctx, "HEAD", path, nil, 1, nil)
 	return err == nil
 }
 
 func (client *COSClient) ListObjects(bucket string) (ObjectList, error) {
+	return client.ListObjectsWithContext(context.Background(), bucket)
+}
+
+func (client *COSClient) ListObjectsWithContext(ctx context.Context, bucket string) (ObjectList, error) {
 	// <ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>dugs</Name><Prefix></Prefix><Marker></Marker><MaxKeys>1000</MaxKeys><Delimiter></Delimiter><IsTruncated>false</IsTruncated><Contents><Key>file2</Key><LastModified>2020-04-25T12:06:55.310Z</LastModified><ETag>&quot;5eb63bbbe01eeed093cb22bb8f5acdc3&quot;</ETag><Size>11</Size><Owner><ID>ad58e4cf-c3f4-49b8-b34a-70a15a416c58</ID><DisplayName>ad58e4cf-c3f4-49b8-b34a-70a15a416c58</DisplayName></Owner><StorageClass>STANDARD</StorageClass></Contents></ListBucketResult>
 	// GET /bucket
 
-	contToken := ""
 	res := ObjectList{}
-
-	svcURL, err := client.GetEndpointForBucket(bucket)
-	if err != nil {
-		return nil, err
-	}
+	opts := &ListObjectsOptions{}
 
 	for {
-		// path := fmt.Sprintf("%s/%s?list-type=2", svcURL, bucket)
-		path := fmt.Sprintf("%s/%s?extended", svcURL, bucket)
-		if contToken != "" {
-			path += "&continuation-token=" + contToken
-			contToken = ""
-		}
-		body, err := client.doHTTP("GET", path, nil, 2, nil)
+		page, err := client.ListObjectsV2(ctx, bucket, opts)
 		if err != nil {
 			return nil, err
 		}
 
-		objects := ObjectListResponse{}
-		err = xml.Unmarshal(body, &objects)
-		if err != nil {
-			return nil, fmt.Errorf("Error parsing result: %s", err)
-		}
-
-		for _, obj := range objects.Contents {
-			newObj := ObjectMetadata{
-				Key:          obj.Key,
-				LastModified: obj.LastModified,
-				Size:         obj.Size,
-				ETag:         obj.ETag,
-			}
-			res = append(res, newObj)
-		}
+		res = append(res, page.Objects...)
 
-		contToken = objects.NextContinuationToken
-		if contToken == "" {
+		if !page.IsTruncated || page.NextContinuationToken == "" {
 			break
 		}
+		opts.ContinuationToken = page.NextContinuationToken
 	}
 
 	return res, nil
 }
 
 func (client *COSClient) UploadObject(bucket, name string, data []byte) error {
+	return client.UploadObjectWithContext(context.Background(), bucket, name, data)
+}
+
+func (client *COSClient) UploadObjectWithContext(ctx context.Context, bucket, name string, data []byte) error {
 	// PUT /bucket/file
 
-	svcURL, err := client.GetEndpointForBucket(bucket)
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
 	if err != nil {
-		return fmt.Errorf("Getting getting endpoint(%s): %s", bucket, err)
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
 	}
 
 	path := fmt.Sprintf("%s/%s/%s", svcURL, bucket, name)
 
-	_, err = client.doHTTP("PUT", path, data, 1, nil)
+	_, err = client.doHTTP(ctx, "PUT", path, data, 1, nil)
 	if err != nil {
-		err = fmt.Errorf("PUT error(%s): %s", path, err)
+		err = fmt.Errorf("PUT error(%s): %w", path, err)
 	}
 	return err
 }
 
+// PutObjectOptions holds the optional settings for PutObject. They're
+// also used when starting a multipart upload and for the new object of
+// a copy.
+type PutObjectOptions struct {
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	CacheControl       string
+	Expires            time.Time
+
+	Metadata map[string]string // Sent as x-amz-meta-<name>
+	Tags     map[string]string // Sent as x-amz-tagging
+
+	StorageClass         string
+	ServerSideEncryption string // e.g. AES256
+
+	// SSECustomerKey encrypts the object with the caller's key (SSE-C),
+	// the same key is needed to read it
+	SSECustomerKey SSECustomerKey
+
+	// Retention for buckets with a protection policy, see retention.go.
+	// RetentionPeriod is in seconds, zero means the bucket's default.
+	RetentionPeriod         int64
+	RetentionExpirationDate time.Time
+	RetentionLegalHoldID    string
+
+	// S3 Object Lock
+	ObjectLockMode            string // e.g. COMPLIANCE
+	ObjectLockRetainUntilDate time.Time
+	ObjectLockLegalHold       string // ON or OFF
+
+	// ContentMD5 is the base64 encoded MD5 of the body, the server rejects
+	// the upload if the data doesn't match. Set SendContentMD5 to have
+	// PutObject calculate it, which requires 'data' to be an io.ReadSeeker.
+	// Ignored by multipart uploads since each part has its own MD5.
+	ContentMD5     string
+	SendContentMD5 bool
+}
+
+func (opts *PutObjectOptions) headers() map[string]string {
+	headers := map[string]string{}
+	if opts == nil {
+		return headers
+	}
+	if opts.ContentType != "" {
+		headers["Content-Type"] = opts.ContentType
+	}
+	if opts.ContentEncoding != "" {
+		headers["Content-Encoding"] = opts.ContentEncoding
+	}
+	if opts.ContentDisposition != "" {
+		headers["Content-Disposition"] = opts.ContentDisposition
+	}
+	if opts.ContentLanguage != "" {
+		headers["Content-Language"] = opts.ContentLanguage
+	}
+	if opts.CacheControl != "" {
+		headers["Cache-Control"] = opts.CacheControl
+	}
+	if !opts.Expires.IsZero() {
+		headers["Expires"] = opts.Expires.UTC().Format(http.TimeFormat)
+	}
+	for k, v := range opts.Metadata {
+		headers["x-amz-meta-"+k] = v
+	}
+	if len(opts.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range opts.Tags {
+			tags.Set(k, v)
+		}
+		headers["x-amz-tagging"] = tags.Encode()
+	}
+	if opts.StorageClass != "" {
+		headers["x-amz-storage-class"] = opts.StorageClass
+	}
+	if opts.ServerSideEncryption != "" {
+		headers["x-amz-server-side-encryption"] = opts.ServerSideEncryption
+	}
+	opts.SSECustomerKey.setHeaders(headers, false)
+	if opts.RetentionPeriod != 0 {
+		headers["Retention-Period"] = strconv.FormatInt(opts.RetentionPeriod, 10)
+	}
+	if !opts.RetentionExpirationDate.IsZero() {
+		headers["Retention-Expiration-Date"] =
+			opts.RetentionExpirationDate.UTC().Format(time.RFC3339)
+	}
+	if opts.RetentionLegalHoldID != "" {
+		headers["Retention-Legal-Hold-ID"] = opts.RetentionLegalHoldID
+	}
+	if opts.ObjectLockMode != "" {
+		headers["x-amz-object-lock-mode"] = opts.ObjectLockMode
+	}
+	if !opts.ObjectLockRetainUntilDate.IsZero() {
+		headers["x-amz-object-lock-retain-until-date"] =
+			opts.ObjectLockRetainUntilDate.UTC().Format(time.RFC3339)
+	}
+	if opts.ObjectLockLegalHold != "" {
+		headers["x-amz-object-lock-legal-hold"] = opts.ObjectLockLegalHold
+	}
+	return headers
+}
+
+// validate checks the options before we send anything.
+func (opts *PutObjectOptions) validate() error {
+	if opts == nil {
+		return nil
+	}
+	if err := opts.SSECustomerKey.validate(); err != nil {
+		return err
+	}
+	if opts.Tags == nil {
+		return nil
+	}
+	return ValidateTags(opts.Tags)
+}
+
+// hasMetadata returns true if any of the object's metadata (as opposed to
+// its tags) is set, used by copy to decide whether to replace it.
+func (opts *PutObjectOptions) hasMetadata() bool {
+	return opts.ContentType != "" || opts.ContentEncoding != "" ||
+		opts.ContentDisposition != "" || opts.ContentLanguage != "" ||
+		opts.CacheControl != "" || !opts.Expires.IsZero() ||
+		opts.Metadata != nil
+}
+
+// hasRetention returns true if any of the COS retention settings are set,
+// used by copy to decide whether to replace the source's retention.
+func (opts *PutObjectOptions) hasRetention() bool {
+	return opts.RetentionPeriod != 0 ||
+		!opts.RetentionExpirationDate.IsZero() ||
+		opts.RetentionLegalHoldID != ""
+}
+
+// UploadInfo describes an object that was just written.
+type UploadInfo struct {
+	Bucket    string
+	Key       string
+	ETag      string
+	Size      int64
+	VersionID string // Only for versioned buckets
+}
+
+// PutObject streams 'data' to bucket/key without buffering it in memory.
+// If 'size' is known it's sent as the Content-Length, otherwise pass -1
+// and the body will be sent using chunked transfer encoding.
+func (client *COSClient) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, opts *PutObjectOptions) (*UploadInfo, error) {
+	// PUT /bucket/file
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", svcURL, bucket, key)
+
+	if data == nil {
+		data, size = bytes.NewReader(nil), 0
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	headers := opts.headers()
+	if opts != nil && opts.ContentMD5 != "" {
+		headers["Content-MD5"] = opts.ContentMD5
+	} else if opts != nil && opts.SendContentMD5 {
+		sum, err := md5ReadSeeker(data)
+		if err != nil {
+			return nil, err
+		}
+		headers["Content-MD5"] = sum
+	}
+
+	res, err := client.doStream(ctx, "PUT", path, data, size, 1, headers)
+	if err != nil {
+		return nil, fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	return &UploadInfo{
+		Bucket:    bucket,
+		Key:       key,
+		ETag:      res.Header.Get("ETag"),
+		Size:      size,
+		VersionID: res.Header.Get("x-amz-version-id"),
+	}, nil
+}
+
+// md5ReadSeeker returns the base64 MD5 of the rest of 'data', leaving its
+// offset where it was.
+func md5ReadSeeker(data io.Reader) (string, error) {
+	seeker, ok := data.(io.ReadSeeker)
+	if !ok {
+		return "", fmt.Errorf("SendContentMD5 requires an io.ReadSeeker")
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", fmt.Errorf("Error calculating MD5: %w", err)
+	}
+	hash := md5.New()
+	if _, err = io.Copy(hash, seeker); err != nil {
+		return "", fmt.Errorf("Error calculating MD5: %w", err)
+	}
+	if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("Error calculating MD5: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
 func (client *COSClient) DeleteObject(bucket, name string) error {
-	// DELETE /bucket/file
+	return client.DeleteObjectWithContext(context.Background(), bucket, name)
+}
+
+func (client *COSClient) DeleteObjectWithContext(ctx context.Context, bucket, name string) error {
+	return client.DeleteObjectWithOptions(ctx, bucket, name, nil)
+}
+
+// DeleteObjectOptions holds the optional settings for
+// DeleteObjectWithOptions.
+type DeleteObjectOptions struct {
+	// VersionID deletes that specific version, otherwise a versioned
+	// bucket just gets a delete marker
+	VersionID string
+}
 
-	svcURL, err := client.GetEndpointForBucket(bucket)
+func (client *COSClient) DeleteObjectWithOptions(ctx context.Context, bucket, name string, opts *DeleteObjectOptions) error {
+	// DELETE /bucket/file?versionId=...
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
 	if err != nil {
-		return fmt.Errorf("Getting getting endpoint(%s): %s", bucket, err)
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
 	}
 
 	path := fmt.Sprintf("%s/%s/%s", svcURL, bucket, name)
+	if opts != nil && opts.VersionID != "" {
+		path += "?versionId=" + url.QueryEscape(opts.VersionID)
+	}
 
-	_, err = client.doHTTP("DELETE", path, nil, 1, nil)
+	_, err = client.doHTTP(ctx, "DELETE", path, nil, 1, nil)
 	if err != nil {
-		err = fmt.Errorf("DELETE error(%s): %s", path, err)
+		err = fmt.Errorf("DELETE error(%s): %w", path, err)
 	}
 	return err
 }
 
 func (client *COSClient) DeleteObjects(bucket string, names []string) error {
-	// DELETE /bucket/file
+	return client.DeleteObjectsWithContext(context.Background(), bucket, names)
+}
+
+func (client *COSClient) DeleteObjectsWithContext(ctx context.Context, bucket string, names []string) error {
+	objects := []ObjectIdentifier{}
+	for _, name := range names {
+		objects = append(objects, ObjectIdentifier{Key: name})
+	}
+	return client.DeleteObjectVersions(ctx, bucket, objects)
+}
+
+// ObjectIdentifier names an object, or one version of it, for
+// DeleteObjectVersions.
+type ObjectIdentifier struct {
+	Key       string
+	VersionID string `xml:"VersionId,omitempty"`
+}
+
+type deleteRequest struct {
+	XMLName xml.Name           `xml:"Delete"`
+	Objects []ObjectIdentifier `xml:"Object"`
+}
 
-	svcURL, err := client.GetEndpointForBucket(bucket)
+// DeleteObjectVersions deletes up to 1000 objects, or specific versions of
+// them, in one request.
+func (client *COSClient) DeleteObjectVersions(ctx context.Context, bucket string, objects []ObjectIdentifier) error {
+	// POST /bucket?delete
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
 	if err != nil {
-		return fmt.Errorf("Getting getting endpoint(%s): %s", bucket, err)
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
 	}
 
 	path := fmt.Sprintf("%s/%s?delete", svcURL, bucket)
 
-	body := "<Delete>"
-	for _, name := range names {
-		body += "<Object><Key>" + name + "</Key></Object>"
+	body, err := xml.Marshal(deleteRequest{Objects: objects})
+	if err != nil {
+		return err
 	}
-	body += "</Delete>"
 
-	sum := md5.Sum([]byte(body))
+	sum := md5.Sum(body)
 
 	headers := map[string]string{}
 	headers["Content-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
 
-	_, err = client.doHTTP("POST", path, []byte(body), 1, headers)
+	// Deleting the same keys twice is harmless so this can be retried
+	body, err = client.doHTTP(withReplayable(ctx), "POST", path, body, 1,
+		headers)
 	if err != nil {
-		err = fmt.Errorf("DELETE/POST error(%s): %s", path, err)
+		return fmt.Errorf("DELETE/POST error(%s): %w", path, err)
 	}
-	return err
+
+	cosErr := &Error{StatusCode: http.StatusOK}
+	if parseError(body, cosErr) {
+		return fmt.Errorf("DELETE/POST error(%s): %w", path, cosErr)
+	}
+
+	// <DeleteResult><Deleted><Key>file1</Key></Deleted><Error><Key>file2</Key><Code>AccessDenied</Code><Message>...</Message></Error></DeleteResult>
+	result := struct {
+		Errors []DeleteError `xml:"Error"`
+	}{}
+	if len(body) > 0 {
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return fmt.Errorf("Error parsing result: %w", err)
+		}
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("DELETE/POST error(%s): %w", path,
+			&DeleteObjectsError{Bucket: bucket, Errors: result.Errors})
+	}
+	return nil
 }
 
 func (client *COSClient) DownloadObject(bucket, name string) ([]byte, error) {
+	return client.DownloadObjectWithContext(context.Background(), bucket, name)
+}
+
+func (client *COSClient) DownloadObjectWithContext(ctx context.Context, bucket, name string) ([]byte, error) {
 	// GET /bucket/file
 
-	svcURL, err := client.GetEndpointForBucket(bucket)
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
 	if err != nil {
-		return nil, fmt.Errorf("Getting getting endpoint(%s): %s", bucket, err)
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
 	}
 
 	path := fmt.Sprintf("%s/%s/%s", svcURL, bucket, name)
 
-	data, err := client.doHTTP("GET", path, nil, 1, nil)
+	data, err := client.doHTTP(ctx, "GET", path, nil, 1,
+		map[string]string{"Accept-Encoding": identityEncoding})
 	return data, err
 }
 
+// identityEncoding is sent as the Accept-Encoding of object GETs.
+// Otherwise net/http asks for gzip and silently decompresses objects that
+// were stored with "Content-Encoding: gzip", so callers wouldn't get the
+// bytes (or size, or Content-Encoding) that are actually stored.
+const identityEncoding = "identity"
+
+// ObjectInfo is the metadata of a single object as returned in the
+// headers of a GET or HEAD on it.
+type ObjectInfo struct {
+	ObjectMetadata // Size is of the whole object, -1 if unknown
+
+	LastModifiedTime   time.Time
+	ContentType        string
+	ContentEncoding    string
+	ContentDisposition string
+	ContentLanguage    string
+	CacheControl       string
+	Expires            time.Time
+	ContentLength      int64             // Length of the body returned, not the object
+	ContentRange       string            // Only set for range requests
+	Metadata           map[string]string // x-amz-meta-* without the prefix
+	TagCount           int
+	VersionID          string
+	DeleteMarker       bool
+
+	// Encryption
+	ServerSideEncryption string // e.g. AES256
+	SSECustomerAlgorithm string // Set when the object uses SSE-C
+	SSECustomerKeyMD5    string
+	KeyProtectRootKeyCRN string // Set when the bucket uses Key Protect/HPCS
+
+	// Immutable Object Storage
+	RetentionExpirationDate   time.Time
+	RetentionLegalHoldCount   int
+	ObjectLockMode            string
+	ObjectLockRetainUntilDate time.Time
+	ObjectLockLegalHold       string // ON or OFF
+
+	// Archive
+	Transition string         // x-ibm-transition, set once archived
+	Restore    *RestoreStatus // nil if no restore was ever requested
+}
+
+// RestoreStatus is the parsed x-amz-restore header of an archived object.
+type RestoreStatus struct {
+	OngoingRequest bool
+	ExpiryDate     time.Time // When the restored copy goes away
+}
+
+var restoreRE = regexp.MustCompile(`([\w-]+)="([^"]*)"`)
+
+// parseRestore parses: ongoing-request="false", expiry-date="Fri, 23 Dec 2012 00:00:00 GMT"
+func parseRestore(value string) *RestoreStatus {
+	if value == "" {
+		return nil
+	}
+	status := &RestoreStatus{}
+	for _, match := range restoreRE.FindAllStringSubmatch(value, -1) {
+		switch match[1] {
+		case "ongoing-request":
+			status.OngoingRequest = match[2] == "true"
+		case "expiry-date":
+			status.ExpiryDate, _ = http.ParseTime(match[2])
+		}
+	}
+	return status
+}
+
+func newObjectInfo(key string, header http.Header) *ObjectInfo {
+	info := &ObjectInfo{
+		ObjectMetadata: ObjectMetadata{
+			Key:          key,
+			LastModified: header.Get("Last-Modified"),
+			ETag:         header.Get("ETag"),
+			Size:         -1,
+			StorageClass: header.Get("x-amz-storage-class"),
+		},
+		ContentType:        header.Get("Content-Type"),
+		ContentEncoding:    header.Get("Content-Encoding"),
+		ContentDisposition: header.Get("Content-Disposition"),
+		ContentLanguage:    header.Get("Content-Language"),
+		CacheControl:       header.Get("Cache-Control"),
+		ContentLength:      -1,
+		ContentRange:       header.Get("Content-Range"),
+		Metadata:           map[string]string{},
+		VersionID:          header.Get("x-amz-version-id"),
+		DeleteMarker:       header.Get("x-amz-delete-marker") == "true",
+
+		ServerSideEncryption: header.Get("x-amz-server-side-encryption"),
+		SSECustomerAlgorithm: header.Get("x-amz-server-side-encryption-customer-algorithm"),
+		SSECustomerKeyMD5:    header.Get("x-amz-server-side-encryption-customer-key-MD5"),
+		KeyProtectRootKeyCRN: header.Get("ibm-sse-kp-customer-root-key-crn"),
+
+		ObjectLockMode:      header.Get("x-amz-object-lock-mode"),
+		ObjectLockLegalHold: header.Get("x-amz-object-lock-legal-hold"),
+
+		Transition: header.Get("x-ibm-transition"),
+		Restore:    parseRestore(header.Get("x-amz-restore")),
+	}
+
+	if t, err := http.ParseTime(info.LastModified); err == nil {
+		info.LastModifiedTime = t
+	}
+	if t, err := http.ParseTime(header.Get("Expires")); err == nil {
+		info.Expires = t
+	}
+	if t, err := http.ParseTime(header.Get("Retention-Expiration-Date")); err == nil {
+		info.RetentionExpirationDate = t
+	}
+	if t, err := time.Parse(time.RFC3339, header.Get("x-amz-object-lock-retain-until-date")); err == nil {
+		info.ObjectLockRetainUntilDate = t
+	}
+	info.RetentionLegalHoldCount, _ = strconv.Atoi(header.Get("Retention-Legal-Hold-Count"))
+	info.TagCount, _ = strconv.Atoi(header.Get("x-amz-tagging-count"))
+
+	if l, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		info.ContentLength = l
+		info.Size = l
+	}
+
+	// Content-Range: bytes 0-99/1234
+	if i := strings.LastIndex(info.ContentRange, "/"); i >= 0 {
+		if total, err := strconv.ParseInt(info.ContentRange[i+1:], 10, 64); err == nil {
+			info.Size = total
+		}
+	}
+
+	for k, v := range header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-meta-") && len(v) > 0 {
+			info.Metadata[k[len("x-amz-meta-"):]] = v[0]
+		}
+	}
+
+	return info
+}
+
+// GetObjectOptions holds the optional settings for GetObject.
+type GetObjectOptions struct {
+	VersionID         string // Latest version if not set
+	Range             string // See ByteRange() and SuffixRange()
+	IfMatch           string
+	IfNoneMatch       string
+	IfModifiedSince   time.Time
+	IfUnmodifiedSince time.Time
+
+	SSECustomerKey SSECustomerKey // Required if the object uses SSE-C
+}
+
+// ByteRange returns a Range value for bytes 'start' thru 'end' inclusive.
+// An 'end' of -1 means the rest of the object.
+func ByteRange(start, end int64) string {
+	if end < 0 {
+		return fmt.Sprintf("bytes=%d-", start)
+	}
+	return fmt.Sprintf("bytes=%d-%d", start, end)
+}
+
+// SuffixRange returns a Range value for the last 'n' bytes of the object.
+func SuffixRange(n int64) string {
+	return fmt.Sprintf("bytes=-%d", n)
+}
+
+// query returns the query string to add to the object's URL.
+func (opts *GetObjectOptions) query() string {
+	if opts == nil || opts.VersionID == "" {
+		return ""
+	}
+	return "?versionId=" + url.QueryEscape(opts.VersionID)
+}
+
+func (opts *GetObjectOptions) headers() map[string]string {
+	headers := map[string]string{}
+	if opts == nil {
+		return headers
+	}
+	if opts.Range != "" {
+		headers["Range"] = opts.Range
+	}
+	if opts.IfMatch != "" {
+		headers["If-Match"] = opts.IfMatch
+	}
+	if opts.IfNoneMatch != "" {
+		headers["If-None-Match"] = opts.IfNoneMatch
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		headers["If-Modified-Since"] = opts.IfModifiedSince.UTC().Format(http.TimeFormat)
+	}
+	if !opts.IfUnmodifiedSince.IsZero() {
+		headers["If-Unmodified-Since"] = opts.IfUnmodifiedSince.UTC().Format(http.TimeFormat)
+	}
+	opts.SSECustomerKey.setHeaders(headers, false)
+	return headers
+}
+
+// GetObject returns the object's contents as a stream rather than reading
+// it all into memory. The caller must close the returned ReadCloser.
+func (client *COSClient) GetObject(ctx context.Context, bucket, key string, opts *GetObjectOptions) (io.ReadCloser, *ObjectInfo, error) {
+	// GET /bucket/file
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s%s", svcURL, bucket, key, opts.query())
+
+	headers := opts.headers()
+	headers["Accept-Encoding"] = identityEncoding
+
+	res, err := client.doStream(ctx, "GET", path, nil, 0, 1, headers)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	return res.Body, newObjectInfo(key, res.Header), nil
+}
+
+// HeadObject returns the object's metadata without downloading it. A
+// missing object returns an error that matches ErrNotFound, but not
+// ErrNoSuchKey since a HEAD has no body to say whether it's the object or
+// the bucket that's missing.
+func (client *COSClient) HeadObject(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	return client.StatObject(ctx, bucket, key, nil)
+}
+
+// StatObject is HeadObject with the same options as GetObject, e.g. to
+// get the metadata of a specific version.
+func (client *COSClient) StatObject(ctx context.Context, bucket, key string, opts *GetObjectOptions) (*ObjectInfo, error) {
+	// HEAD /bucket/file
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s%s", svcURL, bucket, key, opts.query())
+
+	res, err := client.doStream(ctx, "HEAD", path, nil, 0, 1, opts.headers())
+	if err != nil {
+		return nil, fmt.Errorf("HEAD error(%s): %w", path, err)
+	}
+	res.Body.Close()
+
+	return newObjectInfo(key, res.Header), nil
+}
+
 func (client *COSClient) CopyObject(srcBucket, srcName, tgtBucket, tgtName string) error {
-	svcURL, err := client.GetEndpointForBucket(tgtBucket)
+	return client.CopyObjectWithContext(context.Background(), srcBucket, srcName, tgtBucket, tgtName)
+}
+
+func (client *COSClient) CopyObjectWithContext(ctx context.Context, srcBucket, srcName, tgtBucket, tgtName string) error {
+	_, err := client.CopyObjectWithOptions(ctx, srcBucket, srcName,
+		tgtBucket, tgtName, nil)
+	return err
+}
+
+// CopyObjectOptions holds the optional settings for CopyObjectWithOptions.
+type CopyObjectOptions struct {
+	// Settings for the new object. If any metadata is set then it
+	// replaces the source object's metadata (otherwise it's copied as-is),
+	// the same goes for the tags.
+	PutObjectOptions
+
+	SourceVersionID string // Copy this version rather than the latest
+
+	// SourceSSECustomerKey is needed if the source object uses SSE-C
+	SourceSSECustomerKey SSECustomerKey
+}
+
+type copyObjectResult struct {
+	LastModified string
+	ETag         string
+}
+
+// CopyObjectWithOptions copies srcBucket/srcName to tgtBucket/tgtName on
+// the server side.
+func (client *COSClient) CopyObjectWithOptions(ctx context.Context, srcBucket, srcName, tgtBucket, tgtName string, opts *CopyObjectOptions) (*UploadInfo, error) {
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, tgtBucket)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	URL, _ := url.Parse(svcURL)
@@ -755,11 +1566,60 @@ func (client *COSClient) CopyObject(srcBucket, srcName, tgtBucket, tgtName strin
 	svcURL = URL.String()
 
 	path := fmt.Sprintf("%s/%s", svcURL, tgtName)
-	headers := map[string]string{
-		"X-Amz-Copy-Source":       fmt.Sprintf("/%s/%s", srcBucket, srcName),
-		"Ibm-Service-Instance-Id": client.ID,
+	headers := map[string]string{}
+	if opts != nil {
+		if err := opts.validate(); err != nil {
+			return nil, err
+		}
+		headers = opts.headers()
+		if opts.hasMetadata() {
+			headers["x-amz-metadata-directive"] = "REPLACE"
+		}
+		if opts.Tags != nil {
+			headers["x-amz-tagging-directive"] = "REPLACE"
+		}
+		if opts.hasRetention() {
+			headers["Retention-Directive"] = "REPLACE"
+		}
 	}
+	headers["X-Amz-Copy-Source"] = fmt.Sprintf("/%s/%s", srcBucket, srcName)
+	if opts != nil && opts.SourceVersionID != "" {
+		headers["X-Amz-Copy-Source"] += "?versionId=" +
+			url.QueryEscape(opts.SourceVersionID)
+	}
+	if opts != nil {
+		opts.SourceSSECustomerKey.setHeaders(headers, true)
+	}
+	headers["Ibm-Service-Instance-Id"] = client.ID
 
-	_, err = client.doHTTP("PUT", path, nil, 1, headers)
-	return err
+	res, err := client.doStream(ctx, "PUT", path, nil, 0, 1, headers)
+	if err != nil {
+		return nil, fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like CompleteMultipartUpload, a 200 can still carry an <Error>
+	cosErr := &Error{StatusCode: http.StatusOK}
+	if parseError(body, cosErr) {
+		return nil, fmt.Errorf("PUT error(%s): %w", path, cosErr)
+	}
+
+	result := copyObjectResult{}
+	if len(body) > 0 {
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("Error parsing result: %w", err)
+		}
+	}
+
+	return &UploadInfo{
+		Bucket:    tgtBucket,
+		Key:       tgtName,
+		ETag:      result.ETag,
+		Size:      -1,
+		VersionID: res.Header.Get("x-amz-version-id"),
+	}, nil
 }
@@ -0,0 +1,177 @@
+package cosclient
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testInstanceID is long enough for the places that log a prefix of it.
+const testInstanceID = "crn:v1:bluemix:public:cloud-object-storage:global:a/test::"
+
+// newTestClient returns a client with a valid (fake) IAM token so that
+// requests go straight to whatever server the test points them at.
+func newTestClient(t *testing.T, opts ...Option) *COSClient {
+	t.Helper()
+
+	client, err := NewClient("apikey", testInstanceID, opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	client.Token = "test-token"
+	client.Expires = time.Now().Add(time.Hour)
+	return client
+}
+
+func TestGetObjectGzip(t *testing.T) {
+	buf := bytes.Buffer{}
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello world"))
+	zw.Close()
+	stored := buf.Bytes()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ae := r.Header.Get("Accept-Encoding"); ae != "identity" {
+			t.Errorf("Accept-Encoding = %q, want identity", ae)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(stored)))
+		w.Write(stored)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	body, info, err := client.GetObject(context.Background(), "b", "k", nil)
+	if err != nil {
+		t.Fatalf("GetObject: %s", err)
+	}
+	defer body.Close()
+	got, _ := ioutil.ReadAll(body)
+
+	if !bytes.Equal(got, stored) {
+		t.Errorf("got %d bytes, want the %d stored ones", len(got), len(stored))
+	}
+	if info.ContentEncoding != "gzip" || info.Size != int64(len(stored)) {
+		t.Errorf("ContentEncoding = %q, Size = %d", info.ContentEncoding,
+			info.Size)
+	}
+
+	data, err := client.DownloadObject("b", "k")
+	if err != nil || !bytes.Equal(data, stored) {
+		t.Errorf("DownloadObject = %d bytes, %v", len(data), err)
+	}
+}
+
+func TestObjectInfoSize(t *testing.T) {
+	tests := []struct {
+		length string
+		crange string
+		size   int64
+	}{
+		{"", "", -1},
+		{"10", "", 10},
+		{"100", "bytes 0-99/21474836480", 21474836480}, // 20GB
+		{"100", "bytes 0-99/*", 100},
+	}
+
+	for _, test := range tests {
+		header := http.Header{}
+		if test.length != "" {
+			header.Set("Content-Length", test.length)
+		}
+		if test.crange != "" {
+			header.Set("Content-Range", test.crange)
+		}
+		if info := newObjectInfo("k", header); info.Size != test.size {
+			t.Errorf("%q, %q: Size = %d, want %d", test.length,
+				test.crange, info.Size, test.size)
+		}
+	}
+}
+
+// onlyReader hides everything but Read, e.g. Seek, like a pipe or socket.
+type onlyReader struct {
+	r io.Reader
+}
+
+func (r onlyReader) Read(p []byte) (int, error) { return r.r.Read(p) }
+
+func TestPutObjectUnknownSize(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ := ioutil.ReadAll(r.Body)
+		if r.ContentLength != -1 || len(r.TransferEncoding) != 1 ||
+			r.TransferEncoding[0] != "chunked" {
+			t.Errorf("ContentLength = %d, TransferEncoding = %q, want chunked",
+				r.ContentLength, r.TransferEncoding)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Errorf("got %d bytes, want %d", len(buf), len(data))
+		}
+		w.Header().Set("ETag", `"etag"`)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	info, err := client.PutObject(context.Background(), "b", "k",
+		onlyReader{bytes.NewReader(data)}, -1, nil)
+	if err != nil {
+		t.Fatalf("PutObject: %s", err)
+	}
+	if info.ETag != `"etag"` {
+		t.Errorf("ETag = %q", info.ETag)
+	}
+}
+
+func TestPutObjectRetryNeedsSeeker(t *testing.T) {
+	data := []byte("hello world")
+
+	tests := []struct {
+		name string
+		body io.Reader
+		puts int32
+	}{
+		{"seekable", bytes.NewReader(data), 3},
+		{"not seekable", onlyReader{bytes.NewReader(data)}, 1},
+	}
+
+	for _, test := range tests {
+		puts := int32(0)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&puts, 1)
+			if buf, _ := ioutil.ReadAll(r.Body); !bytes.Equal(buf, data) {
+				t.Errorf("%s: body = %q", test.name, buf)
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+		}))
+		client.Endpoints = map[string]string{"b": srv.URL}
+
+		_, err := client.PutObject(context.Background(), "b", "k", test.body,
+			int64(len(data)), nil)
+		srv.Close()
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if puts != test.puts {
+			t.Errorf("%s: PUTs = %d, want %d", test.name, puts, test.puts)
+		}
+	}
+}
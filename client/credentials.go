@@ -0,0 +1,292 @@
+package cosclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials are what a CredentialsProvider found. Any mix of them can be
+// set, see NewClientWithCredentials for how they're used.
+type Credentials struct {
+	APIKey string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	TrustedProfile *TrustedProfile
+
+	// Token is an IAM token to use as-is, see WithToken
+	Token string
+
+	// ResourceInstanceID is the COS instance's CRN, if the source has it
+	ResourceInstanceID string
+
+	Source string // Which provider they came from, for debugging
+}
+
+// TrustedProfile gets IAM tokens by exchanging the compute resource token
+// that Kubernetes (or Code Engine) projects into the pod for a token of
+// the trusted profile. The file is re-read on each refresh since the
+// token is rotated.
+type TrustedProfile struct {
+	ProfileID   string
+	ProfileName string // Needs AccountID, ignored if ProfileID is set
+	AccountID   string
+	CRTokenFile string // Defaults to DefaultCRTokenFile
+}
+
+// DefaultCRTokenFile is where IKS/ROKS project the compute resource token.
+const DefaultCRTokenFile = "/var/run/secrets/tokens/vault-token"
+
+// CredentialsProvider finds credentials. Providers that have nothing to
+// offer return an error that wraps ErrNoCredentials so that a
+// ChainProvider moves on to the next one.
+type CredentialsProvider interface {
+	Retrieve(ctx context.Context) (*Credentials, error)
+}
+
+// NewClientWithCredentials creates a client from what 'provider' finds.
+// An API key or trusted profile is used for IAM tokens, HMAC keys are used
+// for presigned URLs and, when there's no API key or trusted profile, to
+// sign all requests. 'id' defaults to the credentials' ResourceInstanceID.
+func NewClientWithCredentials(ctx context.Context, provider CredentialsProvider, id string, opts ...Option) (*COSClient, error) {
+	creds, err := provider.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	Debug(2, "Using credentials from %s\n", creds.Source)
+
+	if id == "" {
+		id = creds.ResourceInstanceID
+	}
+	if creds.AccessKeyID != "" {
+		opts = append([]Option{WithHMAC(creds.AccessKeyID,
+			creds.SecretAccessKey)}, opts...)
+	}
+	if creds.TrustedProfile != nil {
+		opts = append([]Option{WithTrustedProfile(*creds.TrustedProfile)},
+			opts...)
+	}
+	if creds.Token != "" {
+		opts = append([]Option{WithToken(creds.Token)}, opts...)
+	}
+	return NewClient(creds.APIKey, id, opts...)
+}
+
+// WithTrustedProfile gets IAM tokens for 'profile' rather than with an API
+// key, pass "" as NewClient's apikey.
+func WithTrustedProfile(profile TrustedProfile) Option {
+	return func(opts *clientOptions) error {
+		if profile.ProfileID == "" && profile.ProfileName == "" {
+			return fmt.Errorf("Missing trusted profile ID or name")
+		}
+		opts.trustedProfile = &profile
+		return nil
+	}
+}
+
+// iamGrant returns the body of the IAM token request.
+func (client *COSClient) iamGrant() (string, error) {
+	profile := client.TrustedProfile
+	if profile == nil {
+		return "apikey=" + url.PathEscape(client.APIKey) + "&" +
+			"response_type=cloud_iam&" +
+			"grant_type=urn:ibm:params:oauth:grant-type:apikey", nil
+	}
+
+	file := profile.CRTokenFile
+	if file == "" {
+		file = DefaultCRTokenFile
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("Error reading compute resource token: %w", err)
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "urn:ibm:params:oauth:grant-type:cr-token")
+	values.Set("cr_token", strings.TrimSpace(string(buf)))
+	if profile.ProfileID != "" {
+		values.Set("profile_id", profile.ProfileID)
+	} else {
+		values.Set("profile_name", profile.ProfileName)
+		values.Set("account_id", profile.AccountID)
+	}
+	return values.Encode(), nil
+}
+
+// canRefresh returns true if the client gets its token from IAM itself.
+func (client *COSClient) canRefresh() bool {
+	return client.APIKey != "" || client.TrustedProfile != nil
+}
+
+// StaticProvider always returns the same credentials.
+type StaticProvider struct {
+	Credentials Credentials
+}
+
+func (p *StaticProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	creds := p.Credentials
+	if creds.APIKey == "" && creds.AccessKeyID == "" &&
+		creds.TrustedProfile == nil && creds.Token == "" {
+		return nil, fmt.Errorf("%w: static credentials are empty",
+			ErrNoCredentials)
+	}
+	if creds.Source == "" {
+		creds.Source = "static"
+	}
+	return &creds, nil
+}
+
+// EnvProvider reads IBMCLOUD_API_KEY, COS_HMAC_ACCESS_KEY_ID,
+// COS_HMAC_SECRET_ACCESS_KEY and COS_INSTANCE_ID.
+type EnvProvider struct{}
+
+func (p *EnvProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	creds := &Credentials{
+		APIKey:             os.Getenv("IBMCLOUD_API_KEY"),
+		AccessKeyID:        os.Getenv("COS_HMAC_ACCESS_KEY_ID"),
+		SecretAccessKey:    os.Getenv("COS_HMAC_SECRET_ACCESS_KEY"),
+		ResourceInstanceID: os.Getenv("COS_INSTANCE_ID"),
+		Source:             "environment",
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		creds.AccessKeyID, creds.SecretAccessKey = "", ""
+	}
+	if creds.APIKey == "" && creds.AccessKeyID == "" {
+		return nil, fmt.Errorf("%w: IBMCLOUD_API_KEY and COS_HMAC_* aren't set",
+			ErrNoCredentials)
+	}
+	return creds, nil
+}
+
+// FileProvider reads a COS service credential, the JSON from the IBM Cloud
+// console, from Path. Path defaults to ~/.bluemix/cos_credentials. The
+// ibmcloud CLI's own config (~/.bluemix/config.json) isn't supported, it
+// only has short lived tokens from the last "ibmcloud login".
+type FileProvider struct {
+	Path string
+}
+
+func (p *FileProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	// {"apikey":"...","cos_hmac_keys":{"access_key_id":"...","secret_access_key":"..."},"endpoints":"...","resource_instance_id":"crn:v1:..."}
+	path := p.Path
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrNoCredentials, err)
+		}
+		path = filepath.Join(home, ".bluemix", "cos_credentials")
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s doesn't exist", ErrNoCredentials, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s: %w", path, err)
+	}
+
+	doc := struct {
+		APIKey      string `json:"apikey"`
+		CosHmacKeys struct {
+			AccessKeyID     string `json:"access_key_id"`
+			SecretAccessKey string `json:"secret_access_key"`
+		} `json:"cos_hmac_keys"`
+		ResourceInstanceID string `json:"resource_instance_id"`
+	}{}
+	if err = json.Unmarshal(buf, &doc); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %w", path, err)
+	}
+
+	creds := &Credentials{
+		APIKey:             doc.APIKey,
+		AccessKeyID:        doc.CosHmacKeys.AccessKeyID,
+		SecretAccessKey:    doc.CosHmacKeys.SecretAccessKey,
+		ResourceInstanceID: doc.ResourceInstanceID,
+		Source:             path,
+	}
+	if creds.APIKey == "" && creds.AccessKeyID == "" {
+		return nil, fmt.Errorf("%w: no apikey or cos_hmac_keys in %s",
+			ErrNoCredentials, path)
+	}
+	return creds, nil
+}
+
+// TrustedProfileProvider is used when running in a cluster that projects
+// a compute resource token. The profile comes from the fields or, if
+// they're not set, IBMCLOUD_TRUSTED_PROFILE_ID (or _NAME with
+// IBMCLOUD_ACCOUNT_ID) and IBMCLOUD_CR_TOKEN_FILE.
+type TrustedProfileProvider struct {
+	Profile TrustedProfile
+}
+
+func (p *TrustedProfileProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	profile := p.Profile
+	if profile.ProfileID == "" && profile.ProfileName == "" {
+		profile.ProfileID = os.Getenv("IBMCLOUD_TRUSTED_PROFILE_ID")
+		profile.ProfileName = os.Getenv("IBMCLOUD_TRUSTED_PROFILE_NAME")
+		profile.AccountID = os.Getenv("IBMCLOUD_ACCOUNT_ID")
+	}
+	if profile.CRTokenFile == "" {
+		profile.CRTokenFile = os.Getenv("IBMCLOUD_CR_TOKEN_FILE")
+	}
+	if profile.CRTokenFile == "" {
+		profile.CRTokenFile = DefaultCRTokenFile
+	}
+
+	if profile.ProfileID == "" && profile.ProfileName == "" {
+		return nil, fmt.Errorf("%w: no trusted profile configured",
+			ErrNoCredentials)
+	}
+	if _, err := os.Stat(profile.CRTokenFile); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoCredentials, err)
+	}
+
+	return &Credentials{
+		TrustedProfile: &profile,
+		Source:         "trusted profile",
+	}, nil
+}
+
+// ChainProvider returns the credentials of the first provider that has
+// some. Errors other than ErrNoCredentials stop the search.
+type ChainProvider struct {
+	Providers []CredentialsProvider
+}
+
+// DefaultCredentialsChain looks in the environment, then the credentials
+// file and then for a trusted profile.
+func DefaultCredentialsChain() *ChainProvider {
+	return &ChainProvider{
+		Providers: []CredentialsProvider{
+			&EnvProvider{},
+			&FileProvider{},
+			&TrustedProfileProvider{},
+		},
+	}
+}
+
+func (p *ChainProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	reasons := []string{}
+	for _, provider := range p.Providers {
+		creds, err := provider.Retrieve(ctx)
+		if err == nil {
+			return creds, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			return nil, err
+		}
+		reasons = append(reasons, strings.TrimPrefix(err.Error(),
+			ErrNoCredentials.Error()+": "))
+	}
+	return nil, fmt.Errorf("%w (%s)", ErrNoCredentials,
+		strings.Join(reasons, "; "))
+}
@@ -0,0 +1,291 @@
+package cosclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// credsEnv are all of the env vars the providers look at.
+var credsEnv = []string{
+	"IBMCLOUD_API_KEY", "COS_HMAC_ACCESS_KEY_ID", "COS_HMAC_SECRET_ACCESS_KEY",
+	"COS_INSTANCE_ID", "IBMCLOUD_TRUSTED_PROFILE_ID",
+	"IBMCLOUD_TRUSTED_PROFILE_NAME", "IBMCLOUD_ACCOUNT_ID",
+	"IBMCLOUD_CR_TOKEN_FILE",
+}
+
+// setCredsEnv clears all of credsEnv and then sets 'env', and points HOME
+// at an empty dir so the real ~/.bluemix isn't used.
+func setCredsEnv(t *testing.T, env map[string]string) string {
+	t.Helper()
+	for _, name := range credsEnv {
+		t.Setenv(name, env[name])
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	return home
+}
+
+func TestEnvProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		apikey  string
+		hmacID  string
+		errNone bool // Expect ErrNoCredentials
+	}{
+		{"none", nil, "", "", true},
+		{"apikey", map[string]string{"IBMCLOUD_API_KEY": "key"}, "key", "", false},
+		{"hmac", map[string]string{"COS_HMAC_ACCESS_KEY_ID": "id",
+			"COS_HMAC_SECRET_ACCESS_KEY": "secret"}, "", "id", false},
+		{"both", map[string]string{"IBMCLOUD_API_KEY": "key",
+			"COS_HMAC_ACCESS_KEY_ID":     "id",
+			"COS_HMAC_SECRET_ACCESS_KEY": "secret"}, "key", "id", false},
+		// Half of the HMAC pair is ignored
+		{"hmac no secret", map[string]string{"COS_HMAC_ACCESS_KEY_ID": "id"},
+			"", "", true},
+		{"apikey and hmac no secret", map[string]string{
+			"IBMCLOUD_API_KEY": "key", "COS_HMAC_ACCESS_KEY_ID": "id"},
+			"key", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setCredsEnv(t, test.env)
+			creds, err := (&EnvProvider{}).Retrieve(context.Background())
+			if test.errNone {
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("err = %v, want ErrNoCredentials", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Retrieve: %s", err)
+			}
+			if creds.APIKey != test.apikey || creds.AccessKeyID != test.hmacID {
+				t.Errorf("got %q/%q, want %q/%q", creds.APIKey,
+					creds.AccessKeyID, test.apikey, test.hmacID)
+			}
+		})
+	}
+}
+
+func TestFileProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string // "" means no file
+		apikey   string
+		instance string
+		errNone  bool // Expect ErrNoCredentials
+		errHard  bool // Expect some other error
+	}{
+		{"missing file", "", "", "", true, false},
+		{"bad json", `{"apikey":`, "", "", false, true},
+		{"missing fields", `{"endpoints":"https://..."}`, "", "", true, false},
+		{"apikey", `{"apikey":"key","resource_instance_id":"crn:v1:x"}`,
+			"key", "crn:v1:x", false, false},
+		{"hmac only", `{"cos_hmac_keys":{"access_key_id":"id","secret_access_key":"s"}}`,
+			"", "", false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cos_credentials")
+			if test.contents != "" {
+				if err := ioutil.WriteFile(path, []byte(test.contents), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			creds, err := (&FileProvider{Path: path}).Retrieve(context.Background())
+			switch {
+			case test.errNone:
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("err = %v, want ErrNoCredentials", err)
+				}
+			case test.errHard:
+				if err == nil || errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("err = %v, want a parse error", err)
+				}
+			case err != nil:
+				t.Fatalf("Retrieve: %s", err)
+			default:
+				if creds.APIKey != test.apikey ||
+					creds.ResourceInstanceID != test.instance ||
+					creds.Source != path {
+					t.Errorf("got %+v", creds)
+				}
+			}
+		})
+	}
+}
+
+func TestStaticProvider(t *testing.T) {
+	_, err := (&StaticProvider{}).Retrieve(context.Background())
+	if !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("empty: err = %v, want ErrNoCredentials", err)
+	}
+
+	creds, err := (&StaticProvider{Credentials{APIKey: "key"}}).Retrieve(
+		context.Background())
+	if err != nil || creds.APIKey != "key" || creds.Source != "static" {
+		t.Errorf("got %+v, %v", creds, err)
+	}
+}
+
+func TestTrustedProfileGrant(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("cr-token-value\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		form map[string]string // Expected in the IAM request
+	}{
+		{"id", map[string]string{"IBMCLOUD_TRUSTED_PROFILE_ID": "Profile-1"},
+			map[string]string{"profile_id": "Profile-1"}},
+		{"name", map[string]string{"IBMCLOUD_TRUSTED_PROFILE_NAME": "my-profile",
+			"IBMCLOUD_ACCOUNT_ID": "acct"},
+			map[string]string{"profile_name": "my-profile", "account_id": "acct"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := map[string]string{"IBMCLOUD_CR_TOKEN_FILE": tokenFile}
+			for k, v := range test.env {
+				env[k] = v
+			}
+			setCredsEnv(t, env)
+
+			iam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				want := map[string]string{
+					"grant_type": "urn:ibm:params:oauth:grant-type:cr-token",
+					"cr_token":   "cr-token-value",
+				}
+				for k, v := range test.form {
+					want[k] = v
+				}
+				for k, v := range want {
+					if got := r.Form.Get(k); got != v {
+						t.Errorf("%s = %q, want %q", k, got, v)
+					}
+				}
+				if r.Form.Get("apikey") != "" {
+					t.Errorf("unexpected apikey in %q", r.Form)
+				}
+				fmt.Fprintf(w, `{"access_token":"token1","expiration":%d}`,
+					time.Now().Add(time.Hour).Unix())
+			}))
+			defer iam.Close()
+
+			client, err := NewClientWithCredentials(context.Background(),
+				&TrustedProfileProvider{}, testInstanceID)
+			if err != nil {
+				t.Fatalf("NewClientWithCredentials: %s", err)
+			}
+			client.IAMEndpoint = iam.URL
+
+			if token, err := client.GetToken(context.Background()); token != "token1" ||
+				err != nil {
+				t.Errorf("GetToken() = %q, %v", token, err)
+			}
+		})
+	}
+
+	// No profile, or no token file, means there's nothing to offer
+	setCredsEnv(t, map[string]string{"IBMCLOUD_CR_TOKEN_FILE": tokenFile})
+	if _, err := (&TrustedProfileProvider{}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no profile: err = %v, want ErrNoCredentials", err)
+	}
+	setCredsEnv(t, map[string]string{"IBMCLOUD_TRUSTED_PROFILE_ID": "p",
+		"IBMCLOUD_CR_TOKEN_FILE": tokenFile + ".missing"})
+	if _, err := (&TrustedProfileProvider{}).Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("no token file: err = %v, want ErrNoCredentials", err)
+	}
+}
+
+// providerFunc makes a func a CredentialsProvider.
+type providerFunc func() (*Credentials, error)
+
+func (f providerFunc) Retrieve(ctx context.Context) (*Credentials, error) {
+	return f()
+}
+
+func TestChainProvider(t *testing.T) {
+	none := providerFunc(func() (*Credentials, error) {
+		return nil, fmt.Errorf("%w: nothing here", ErrNoCredentials)
+	})
+	hard := providerFunc(func() (*Credentials, error) {
+		return nil, fmt.Errorf("permission denied")
+	})
+	found := func(source string) CredentialsProvider {
+		return providerFunc(func() (*Credentials, error) {
+			return &Credentials{APIKey: "key", Source: source}, nil
+		})
+	}
+
+	tests := []struct {
+		name      string
+		providers []CredentialsProvider
+		source    string
+		errNone   bool
+	}{
+		{"first", []CredentialsProvider{found("a"), found("b")}, "a", false},
+		{"fall through", []CredentialsProvider{none, none, found("c")}, "c", false},
+		{"hard error stops", []CredentialsProvider{none, hard, found("c")}, "", false},
+		{"nothing", []CredentialsProvider{none, none}, "", true},
+	}
+
+	for _, test := range tests {
+		creds, err := (&ChainProvider{test.providers}).Retrieve(context.Background())
+		switch {
+		case test.source != "":
+			if err != nil || creds.Source != test.source {
+				t.Errorf("%s: got %+v, %v", test.name, creds, err)
+			}
+		case test.errNone:
+			if !errors.Is(err, ErrNoCredentials) {
+				t.Errorf("%s: err = %v, want ErrNoCredentials", test.name, err)
+			}
+		default:
+			if err == nil || errors.Is(err, ErrNoCredentials) {
+				t.Errorf("%s: err = %v, want the hard error", test.name, err)
+			}
+		}
+	}
+}
+
+func TestDefaultCredentialsChain(t *testing.T) {
+	home := setCredsEnv(t, nil)
+	if _, err := DefaultCredentialsChain().Retrieve(context.Background()); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("empty: err = %v, want ErrNoCredentials", err)
+	}
+
+	dir := filepath.Join(home, ".bluemix")
+	os.MkdirAll(dir, 0700)
+	if err := ioutil.WriteFile(filepath.Join(dir, "cos_credentials"),
+		[]byte(`{"apikey":"file-key"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := DefaultCredentialsChain().Retrieve(context.Background())
+	if err != nil || creds.APIKey != "file-key" {
+		t.Errorf("file: got %+v, %v", creds, err)
+	}
+
+	// The environment wins over the file
+	t.Setenv("IBMCLOUD_API_KEY", "env-key")
+	creds, err = DefaultCredentialsChain().Retrieve(context.Background())
+	if err != nil || creds.APIKey != "env-key" {
+		t.Errorf("env: got %+v, %v", creds, err)
+	}
+}
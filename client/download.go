@@ -0,0 +1,222 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// MultipartDownloader fetches an object using parallel range requests and
+// writes each range directly into its spot in an io.WriterAt, such as an
+// *os.File.
+type MultipartDownloader struct {
+	Client      *COSClient
+	PartSize    int64 // Defaults to DefaultPartSize
+	Concurrency int   // Max # of ranges in flight
+	MaxRetries  int   // Per range
+
+	// Verify checks the MD5 of the downloaded data against the object's
+	// ETag. This is only possible when the ETag is a plain MD5 (i.e. not
+	// a multipart upload or SSE-C) and the WriterAt is also an io.ReaderAt.
+	Verify bool
+
+	SSECustomerKey SSECustomerKey // Required if the object uses SSE-C
+}
+
+func (client *COSClient) NewMultipartDownloader() *MultipartDownloader {
+	return &MultipartDownloader{
+		Client:      client,
+		PartSize:    DefaultPartSize,
+		Concurrency: 4,
+		MaxRetries:  3,
+		Verify:      true,
+	}
+}
+
+// Download writes bucket/key into 'w' and returns the object's metadata.
+func (d *MultipartDownloader) Download(ctx context.Context, bucket, key string, w io.WriterAt) (*ObjectInfo, error) {
+	partSize := d.PartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	concurrency := d.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	info, err := d.Client.StatObject(ctx, bucket, key,
+		&GetObjectOptions{SSECustomerKey: d.SSECustomerKey})
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size
+	if size < 0 {
+		return nil, fmt.Errorf("Size of %s/%s is unknown, can't download it in ranges",
+			bucket, key)
+	}
+	Debug(2, "Downloading %s/%s: %d bytes\n", bucket, key, size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var resErr error
+	sem := make(chan struct{}, concurrency)
+
+	for start := int64(0); start < size; start += partSize {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		wg.Add(1)
+		go func(start, end int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := d.downloadRange(ctx, bucket, key, info.ETag, start, end, w)
+			if err != nil {
+				mutex.Lock()
+				if resErr == nil {
+					resErr = err
+				}
+				mutex.Unlock()
+				cancel()
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+
+	if resErr == nil {
+		resErr = ctx.Err()
+	}
+	if resErr != nil {
+		return nil, resErr
+	}
+
+	// With SSE-C the ETag isn't the MD5 of the data
+	if d.Verify && info.SSECustomerAlgorithm == "" {
+		if err := verifyMD5(w, size, info.ETag); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// downloadRange gets bytes 'start' thru 'end' and writes them at the same
+// offset in 'w'. Transient failures are retried, up to MaxRetries times,
+// starting from where the previous attempt left off. The ETag is passed as
+// If-Match so that we notice if the object is replaced mid-download.
+func (d *MultipartDownloader) downloadRange(ctx context.Context, bucket, key, etag string, start, end int64, w io.WriterAt) error {
+	from := start
+	// Like the uploader, the retries are done here rather than by each
+	// request, see MultipartUploader.uploadPart
+	policy := d.Client.retryPolicy()
+	rangeCtx := withoutRetries(ctx)
+
+	var err error
+	for attempt := 0; attempt <= d.MaxRetries; attempt++ {
+		if attempt > 0 {
+			event := RetryEvent{
+				Method:  "GET",
+				Path:    fmt.Sprintf("%s/%s bytes %d-%d", bucket, key, start, end),
+				Attempt: attempt,
+				Err:     err,
+				Delay:   policy.backoff(attempt, ""),
+			}
+			if err := policy.wait(ctx, event); err != nil {
+				return err
+			}
+		}
+
+		opts := &GetObjectOptions{
+			Range:          ByteRange(start, end),
+			IfMatch:        etag,
+			SSECustomerKey: d.SSECustomerKey,
+		}
+
+		var body io.ReadCloser
+		var info *ObjectInfo
+		body, info, err = d.Client.GetObject(rangeCtx, bucket, key, opts)
+		if err == nil && info.ContentRange == "" {
+			// A 200 with the whole object, writing it at 'start' would
+			// overwrite the other ranges
+			body.Close()
+			return fmt.Errorf("Range %d-%d of %s/%s: server ignored the Range header",
+				from, end, bucket, key)
+		}
+		if err == nil {
+			var n int64
+			n, err = io.Copy(&offsetWriter{w: w, offset: start},
+				io.LimitReader(body, end-start+1))
+			body.Close()
+			start += n
+			if err == nil && start <= end {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !isRetryableErr(err) {
+			break
+		}
+	}
+
+	return fmt.Errorf("Error downloading range %d-%d: %w", from, end, err)
+}
+
+// offsetWriter turns sequential writes into WriteAt calls.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
+
+// verifyMD5 reads back what was written and compares it to the ETag,
+// skipping the check when that isn't possible.
+func verifyMD5(w io.WriterAt, size int64, etag string) error {
+	etag = strings.Trim(etag, `"`)
+	if len(etag) != 2*md5.Size || strings.Contains(etag, "-") {
+		Debug(2, "Can't verify ETag %q, not an MD5\n", etag)
+		return nil
+	}
+
+	r, ok := w.(io.ReaderAt)
+	if !ok {
+		Debug(2, "Can't verify ETag, WriterAt isn't a ReaderAt\n")
+		return nil
+	}
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(r, 0, size)); err != nil {
+		return fmt.Errorf("Error reading data to verify: %w", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != etag {
+		return fmt.Errorf("MD5 mismatch: got %s, expected %s", sum, etag)
+	}
+	return nil
+}
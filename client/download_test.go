@@ -0,0 +1,193 @@
+package cosclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveObject serves 'data' with 'etag', handling HEAD, Range and
+// If-Match. 'hook', if set, is called first for each GET and can take
+// over the request by returning true.
+func serveObject(t *testing.T, data []byte, etag string, hook func(w http.ResponseWriter, r *http.Request) bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && hook != nil && hook(w, r) {
+			return
+		}
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestDownloader(t *testing.T, srv *httptest.Server) *MultipartDownloader {
+	client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Millisecond,
+	}))
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	d := client.NewMultipartDownloader()
+	d.PartSize = 100
+	d.MaxRetries = 2
+	return d
+}
+
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func TestDownload(t *testing.T) {
+	data := make([]byte, 1050)
+	rand.Read(data)
+
+	inflight, maxInflight, gets := int32(0), int32(0), int32(0)
+	srv := serveObject(t, data, md5ETag(data), func(w http.ResponseWriter, r *http.Request) bool {
+		atomic.AddInt32(&gets, 1)
+		n := atomic.AddInt32(&inflight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&inflight, -1)
+		return false
+	})
+
+	d := newTestDownloader(t, srv)
+	d.Concurrency = 3
+
+	buf := &bufferAt{}
+	info, err := d.Download(context.Background(), "b", "k", buf)
+	if err != nil {
+		t.Fatalf("Download: %s", err)
+	}
+	if !bytes.Equal(buf.buf, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	if info.Size != int64(len(data)) {
+		t.Errorf("Size = %d", info.Size)
+	}
+	if gets != 11 {
+		t.Errorf("GETs = %d, want 11", gets)
+	}
+	if maxInflight < 2 || maxInflight > 3 {
+		t.Errorf("max GETs in flight = %d, want 2 or 3", maxInflight)
+	}
+}
+
+func TestDownloadRetryMidRange(t *testing.T) {
+	data := make([]byte, 300)
+	rand.Read(data)
+
+	var mutex sync.Mutex
+	ranges := []string{}
+	failed := int32(0)
+	srv := serveObject(t, data, md5ETag(data), func(w http.ResponseWriter, r *http.Request) bool {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mutex.Unlock()
+
+		if r.Header.Get("Range") == "bytes=100-199" &&
+			atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			// Send half of the range and then drop the connection
+			w.Header().Set("Content-Range", "bytes 100-199/300")
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[100:150])
+			return true
+		}
+		return false
+	})
+
+	d := newTestDownloader(t, srv)
+	buf := &bufferAt{}
+	if _, err := d.Download(context.Background(), "b", "k", buf); err != nil {
+		t.Fatalf("Download: %s", err)
+	}
+	if !bytes.Equal(buf.buf, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+
+	// The retry picks up where the first attempt left off
+	found := false
+	for _, r := range ranges {
+		found = found || r == "bytes=150-199"
+	}
+	if !found {
+		t.Errorf("ranges = %q, want a retry of bytes=150-199", ranges)
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 25))
+
+	tests := []struct {
+		name  string
+		etag  string
+		hook  func(w http.ResponseWriter, r *http.Request) bool
+		isErr error
+		msg   string
+	}{
+		{"object replaced", md5ETag(data),
+			func(w http.ResponseWriter, r *http.Request) bool {
+				// The ETag no longer matches the one from the HEAD
+				w.Header().Set("ETag", `"new"`)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+				return true
+			}, ErrPreconditionFailed, "range 0-99"},
+		{"md5 mismatch", md5ETag([]byte("something else")), nil, nil,
+			"MD5 mismatch"},
+		{"range ignored", md5ETag(data),
+			func(w http.ResponseWriter, r *http.Request) bool {
+				w.Write(data)
+				return true
+			}, nil, "ignored the Range header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := serveObject(t, data, test.etag, test.hook)
+			d := newTestDownloader(t, srv)
+			d.Concurrency = 1
+
+			_, err := d.Download(context.Background(), "b", "k", &bufferAt{})
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if test.isErr != nil && !errors.Is(err, test.isErr) {
+				t.Errorf("err = %v, want %v", err, test.isErr)
+			}
+			if !strings.Contains(err.Error(), test.msg) {
+				t.Errorf("err = %v, want %q", err, test.msg)
+			}
+		})
+	}
+
+	// With no Content-Length on the HEAD there's nothing to split up
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("unexpected %s", r.Method)
+		}
+	}))
+	defer srv.Close()
+	d := newTestDownloader(t, srv)
+	if _, err := d.Download(context.Background(), "b", "k", &bufferAt{}); err == nil ||
+		!strings.Contains(err.Error(), "unknown") {
+		t.Errorf("unknown size: err = %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+)
+
+// https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-encryption
+
+// SSECustomerAlgorithmAES256 is the only algorithm COS supports for SSE-C
+// and Key Protect.
+const SSECustomerAlgorithmAES256 = "AES256"
+
+// SSECustomerKey is a 256 bit key for SSE-C (server-side encryption with
+// customer provided keys). COS doesn't keep the key so the same one has
+// to be passed in on every request that reads the object.
+type SSECustomerKey []byte
+
+func (key SSECustomerKey) validate() error {
+	if key != nil && len(key) != 32 {
+		return fmt.Errorf("SSE-C key must be 32 bytes, not %d", len(key))
+	}
+	return nil
+}
+
+// setHeaders adds the SSE-C headers for 'key' to 'headers'. The copy
+// source variants are used when 'source' is true.
+func (key SSECustomerKey) setHeaders(headers map[string]string, source bool) {
+	if key == nil {
+		return
+	}
+	prefix := "x-amz-server-side-encryption-customer-"
+	if source {
+		prefix = "x-amz-copy-source-server-side-encryption-customer-"
+	}
+
+	sum := md5.Sum(key)
+	headers[prefix+"algorithm"] = SSECustomerAlgorithmAES256
+	headers[prefix+"key"] = base64.StdEncoding.EncodeToString(key)
+	headers[prefix+"key-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// BucketKeyProtect is a bucket's Key Protect / HPCS settings.
+type BucketKeyProtect struct {
+	Enabled    bool
+	RootKeyCRN string
+}
+
+// GetBucketKeyProtect returns whether the bucket was created with a Key
+// Protect or HPCS root key, see CreateBucketOptions.
+func (client *COSClient) GetBucketKeyProtect(ctx context.Context, bucket string) (*BucketKeyProtect, error) {
+	// HEAD /bucket
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s", svcURL, bucket)
+
+	res, err := client.doStream(ctx, "HEAD", path, nil, 0, 1, nil)
+	if err != nil {
+		return nil, fmt.Errorf("HEAD error(%s): %w", path, err)
+	}
+	res.Body.Close()
+
+	return &BucketKeyProtect{
+		Enabled:    res.Header.Get("ibm-sse-kp-enabled") == "true",
+		RootKeyCRN: res.Header.Get("ibm-sse-kp-customer-root-key-crn"),
+	}, nil
+}
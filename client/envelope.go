@@ -0,0 +1,411 @@
+package cosclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+)
+
+// Client-side (envelope) encryption. Each object gets its own random data
+// key that encrypts the data with AES-256-GCM. The data key is wrapped by
+// a KeyProvider and stored, along with everything else needed to decrypt
+// the object, in its metadata:
+//
+//	x-amz-meta-cse-alg         EnvelopeAlgorithm
+//	x-amz-meta-cse-chunk-size  # of plaintext bytes per chunk
+//	x-amz-meta-cse-nonce       base64 nonce prefix
+//	x-amz-meta-cse-key         base64 wrapped data key
+//	x-amz-meta-cse-key-id      the KeyProvider's ID of the wrapping key
+//	x-amz-meta-cse-wrap-alg    how the data key was wrapped
+//
+// The data is split into chunks that are sealed on their own so that
+// neither side has to hold the whole object in memory. Each chunk's nonce
+// is the nonce prefix plus the chunk's number and the last chunk is marked
+// in its additional data, so chunks can't be reordered, dropped or cut off
+// without decryption failing.
+
+// EnvelopeAlgorithm is the only client-side encryption format supported.
+const EnvelopeAlgorithm = "AES256-GCM-CHUNKED"
+
+const (
+	envelopeChunkSize    = 64 * 1024
+	envelopeMaxChunkSize = DefaultPartSize
+	envelopeNonceSize    = 8  // Plus a 4 byte chunk counter for GCM's 12
+	envelopeOverhead     = 16 // GCM's tag, added to each chunk
+)
+
+// WrappedKey is a data key that was encrypted by a KeyProvider.
+type WrappedKey struct {
+	Key       []byte
+	KeyID     string // Which of the provider's keys wrapped it
+	Algorithm string
+}
+
+// KeyProvider wraps and unwraps the per-object data keys, e.g. with a
+// local master key (see LocalKeyProvider) or a KMS.
+type KeyProvider interface {
+	WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error)
+	UnwrapKey(ctx context.Context, key *WrappedKey) ([]byte, error)
+}
+
+// EncryptionClient encrypts objects before they're uploaded and decrypts
+// them as they're downloaded, so the data never leaves the process in
+// plaintext. Objects can only be read back through an EncryptionClient
+// whose KeyProvider can unwrap their data keys.
+type EncryptionClient struct {
+	Client      *COSClient
+	KeyProvider KeyProvider
+
+	// AllowUnencrypted returns objects that weren't encrypted as-is
+	// rather than failing with ErrNotEncrypted
+	AllowUnencrypted bool
+}
+
+func (client *COSClient) NewEncryptionClient(provider KeyProvider) *EncryptionClient {
+	return &EncryptionClient{
+		Client:      client,
+		KeyProvider: provider,
+	}
+}
+
+// PutObject encrypts 'data' and uploads it as bucket/key. 'size' is the
+// size of the plaintext, or -1 if it's not known in which case a multipart
+// upload is used. ContentMD5 and SendContentMD5 are ignored since they'd
+// describe the plaintext.
+func (ec *EncryptionClient) PutObject(ctx context.Context, bucket, key string, data io.Reader, size int64, opts *PutObjectOptions) (*UploadInfo, error) {
+	dataKey := make([]byte, 32)
+	nonce := make([]byte, envelopeNonceSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("Error generating data key: %w", err)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Error generating nonce: %w", err)
+	}
+
+	wrapped, err := ec.KeyProvider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error wrapping data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't touch the caller's options
+	encOpts := PutObjectOptions{}
+	if opts != nil {
+		encOpts = *opts
+	}
+	encOpts.ContentMD5 = ""
+	encOpts.SendContentMD5 = false
+	encOpts.Metadata = map[string]string{}
+	if opts != nil {
+		for k, v := range opts.Metadata {
+			encOpts.Metadata[k] = v
+		}
+	}
+	encOpts.Metadata["cse-alg"] = EnvelopeAlgorithm
+	encOpts.Metadata["cse-chunk-size"] = strconv.Itoa(envelopeChunkSize)
+	encOpts.Metadata["cse-nonce"] = base64.StdEncoding.EncodeToString(nonce)
+	encOpts.Metadata["cse-key"] = base64.StdEncoding.EncodeToString(wrapped.Key)
+	encOpts.Metadata["cse-key-id"] = wrapped.KeyID
+	encOpts.Metadata["cse-wrap-alg"] = wrapped.Algorithm
+
+	if data == nil {
+		data, size = bytes.NewReader(nil), 0
+	}
+	reader := newEncryptReader(data, aead, nonce, envelopeChunkSize)
+
+	var info *UploadInfo
+	if size < 0 {
+		info, err = ec.Client.NewMultipartUploader().Upload(ctx, bucket, key,
+			reader, &encOpts)
+	} else {
+		info, err = ec.Client.PutObject(ctx, bucket, key, reader,
+			encryptedSize(size, envelopeChunkSize), &encOpts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info.Size = reader.size
+	return info, nil
+}
+
+// GetObject downloads bucket/key and decrypts it as it's read. The
+// returned ObjectInfo has the size of the plaintext. Range reads aren't
+// supported. Errors from the returned reader mean the data was tampered
+// with, or corrupted, and none of what was read so far should be trusted.
+func (ec *EncryptionClient) GetObject(ctx context.Context, bucket, key string, opts *GetObjectOptions) (io.ReadCloser, *ObjectInfo, error) {
+	if opts != nil && opts.Range != "" {
+		return nil, nil, fmt.Errorf("Range reads of encrypted objects aren't supported")
+	}
+
+	body, info, err := ec.Client.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := ec.decrypt(ctx, body, info)
+	if err != nil {
+		body.Close()
+		return nil, nil, fmt.Errorf("Error decrypting %s/%s: %w", bucket, key, err)
+	}
+	return reader, info, nil
+}
+
+// HeadObject is COSClient.HeadObject but with the size of the plaintext.
+func (ec *EncryptionClient) HeadObject(ctx context.Context, bucket, key string) (*ObjectInfo, error) {
+	info, err := ec.Client.HeadObject(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize, err := envelopeChunk(info); err == nil && chunkSize > 0 {
+		if info.Size >= 0 {
+			info.Size = plaintextSize(info.Size, chunkSize)
+		}
+	}
+	return info, nil
+}
+
+// UploadObject is the []byte version of PutObject.
+func (ec *EncryptionClient) UploadObject(ctx context.Context, bucket, name string, data []byte) error {
+	_, err := ec.PutObject(ctx, bucket, name, bytes.NewReader(data),
+		int64(len(data)), nil)
+	return err
+}
+
+// DownloadObject is the []byte version of GetObject.
+func (ec *EncryptionClient) DownloadObject(ctx context.Context, bucket, name string) ([]byte, error) {
+	body, _, err := ec.GetObject(ctx, bucket, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(body)
+}
+
+// decrypt wraps 'body' with a reader that decrypts it, based on the
+// envelope in the object's metadata.
+func (ec *EncryptionClient) decrypt(ctx context.Context, body io.ReadCloser, info *ObjectInfo) (io.ReadCloser, error) {
+	chunkSize, err := envelopeChunk(info)
+	if err != nil {
+		return nil, err
+	}
+	if chunkSize == 0 {
+		if ec.AllowUnencrypted {
+			return body, nil
+		}
+		return nil, ErrNotEncrypted
+	}
+
+	nonce, err := base64.StdEncoding.DecodeString(info.Metadata["cse-nonce"])
+	if err != nil || len(nonce) != envelopeNonceSize {
+		return nil, fmt.Errorf("Invalid cse-nonce")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(info.Metadata["cse-key"])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cse-key: %w", err)
+	}
+
+	dataKey, err := ec.KeyProvider.UnwrapKey(ctx, &WrappedKey{
+		Key:       wrapped,
+		KeyID:     info.Metadata["cse-key-id"],
+		Algorithm: info.Metadata["cse-wrap-alg"],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error unwrapping data key: %w", err)
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Size >= 0 {
+		info.Size = plaintextSize(info.Size, chunkSize)
+		info.ContentLength = info.Size
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{newDecryptReader(body, aead, nonce, chunkSize), body}, nil
+}
+
+// envelopeChunk returns the object's chunk size, or zero if it wasn't
+// encrypted by an EncryptionClient.
+func envelopeChunk(info *ObjectInfo) (int64, error) {
+	alg := info.Metadata["cse-alg"]
+	if alg == "" {
+		return 0, nil
+	}
+	if alg != EnvelopeAlgorithm {
+		return 0, fmt.Errorf("Unsupported encryption algorithm %q", alg)
+	}
+	chunkSize, err := strconv.ParseInt(info.Metadata["cse-chunk-size"], 10, 64)
+	if err != nil || chunkSize < 1 || chunkSize > envelopeMaxChunkSize {
+		return 0, fmt.Errorf("Invalid cse-chunk-size %q",
+			info.Metadata["cse-chunk-size"])
+	}
+	return chunkSize, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedSize is the size of 'size' bytes of plaintext once encrypted.
+// There's always at least one chunk, even for no data.
+func encryptedSize(size, chunkSize int64) int64 {
+	chunks := (size + chunkSize - 1) / chunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return size + chunks*envelopeOverhead
+}
+
+// plaintextSize is the reverse of encryptedSize.
+func plaintextSize(size, chunkSize int64) int64 {
+	chunks := (size + chunkSize + envelopeOverhead - 1) /
+		(chunkSize + envelopeOverhead)
+	if size -= chunks * envelopeOverhead; size < 0 {
+		size = 0
+	}
+	return size
+}
+
+// chunkNonce returns the nonce, and additional data, for chunk # 'count'.
+func chunkNonce(nonce []byte, prefix []byte, count uint32, last bool) []byte {
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[envelopeNonceSize:], count)
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// envelopeReader has what's common to encryptReader and decryptReader,
+// reading 'src' a chunk at a time with a peek to see if it's the last one.
+type envelopeReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	nonce  []byte
+	chunk  []byte // Input buffer
+	buf    []byte // Output buffer
+	out    []byte // What's left of the output to be read
+	count  uint32
+	done   bool
+}
+
+func newEnvelopeReader(src io.Reader, aead cipher.AEAD, prefix []byte, inSize, outSize int64) envelopeReader {
+	return envelopeReader{
+		src:    bufio.NewReaderSize(src, int(inSize)),
+		aead:   aead,
+		prefix: prefix,
+		nonce:  make([]byte, aead.NonceSize()),
+		chunk:  make([]byte, inSize),
+		buf:    make([]byte, 0, outSize),
+	}
+}
+
+// next reads the next chunk and says whether it's the last one.
+func (r *envelopeReader) next() ([]byte, bool, error) {
+	n, err := io.ReadFull(r.src, r.chunk)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, false, err
+	}
+	last := n < len(r.chunk)
+	if !last {
+		if _, err = r.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	return r.chunk[:n], last, nil
+}
+
+func (r *envelopeReader) read(p []byte, fill func() error) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := fill(); err != nil {
+			return 0, err
+		}
+		r.count++
+		if r.count == 0 {
+			return 0, fmt.Errorf("Too many chunks")
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+type encryptReader struct {
+	envelopeReader
+	size int64 // # of plaintext bytes read so far
+}
+
+func newEncryptReader(src io.Reader, aead cipher.AEAD, prefix []byte, chunkSize int64) *encryptReader {
+	return &encryptReader{envelopeReader: newEnvelopeReader(src, aead,
+		prefix, chunkSize, chunkSize+envelopeOverhead)}
+}
+
+func (r *encryptReader) Read(p []byte) (int, error) {
+	return r.read(p, func() error {
+		chunk, last, err := r.next()
+		if err != nil {
+			return err
+		}
+		ad := chunkNonce(r.nonce, r.prefix, r.count, last)
+		r.out = r.aead.Seal(r.buf[:0], r.nonce, chunk, ad)
+		r.size += int64(len(chunk))
+		r.done = last
+		return nil
+	})
+}
+
+type decryptReader struct {
+	envelopeReader
+}
+
+func newDecryptReader(src io.Reader, aead cipher.AEAD, prefix []byte, chunkSize int64) *decryptReader {
+	return &decryptReader{newEnvelopeReader(src, aead, prefix,
+		chunkSize+envelopeOverhead, chunkSize)}
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	return r.read(p, func() error {
+		chunk, last, err := r.next()
+		if err != nil {
+			return err
+		}
+		if len(chunk) < envelopeOverhead {
+			return fmt.Errorf("Encrypted data is truncated")
+		}
+		ad := chunkNonce(r.nonce, r.prefix, r.count, last)
+		r.out, err = r.aead.Open(r.buf[:0], r.nonce, chunk, ad)
+		if err != nil {
+			return fmt.Errorf("Error decrypting chunk %d: %w", r.count, err)
+		}
+		r.done = last
+		return nil
+	})
+}
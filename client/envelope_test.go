@@ -0,0 +1,133 @@
+package cosclient
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io/ioutil"
+	"testing"
+)
+
+func testEnvelopeGCM(t *testing.T) (cipher.AEAD, []byte) {
+	t.Helper()
+	key := make([]byte, 32)
+	prefix := make([]byte, envelopeNonceSize)
+	rand.Read(key)
+	rand.Read(prefix)
+
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatalf("newGCM: %s", err)
+	}
+	return aead, prefix
+}
+
+func encryptAll(t *testing.T, aead cipher.AEAD, prefix, data []byte, chunkSize int64) []byte {
+	t.Helper()
+	r := newEncryptReader(bytes.NewReader(data), aead, prefix, chunkSize)
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("encrypting: %s", err)
+	}
+	if r.size != int64(len(data)) {
+		t.Errorf("encryptReader.size = %d, want %d", r.size, len(data))
+	}
+	return out
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	aead, prefix := testEnvelopeGCM(t)
+	chunk := int64(envelopeChunkSize)
+
+	for _, size := range []int64{0, 1, chunk - 1, chunk, chunk + 1, 3*chunk + 5,
+		4 * chunk} {
+
+		data := make([]byte, size)
+		rand.Read(data)
+
+		enc := encryptAll(t, aead, prefix, data, chunk)
+		if int64(len(enc)) != encryptedSize(size, chunk) {
+			t.Errorf("size %d: encrypted to %d bytes, encryptedSize() = %d",
+				size, len(enc), encryptedSize(size, chunk))
+		}
+		if got := plaintextSize(int64(len(enc)), chunk); got != size {
+			t.Errorf("size %d: plaintextSize(%d) = %d", size, len(enc), got)
+		}
+
+		dec, err := ioutil.ReadAll(newDecryptReader(bytes.NewReader(enc), aead,
+			prefix, chunk))
+		if err != nil {
+			t.Fatalf("size %d: decrypting: %s", size, err)
+		}
+		if !bytes.Equal(dec, data) {
+			t.Errorf("size %d: decrypted data doesn't match", size)
+		}
+	}
+}
+
+func TestEnvelopeTamper(t *testing.T) {
+	aead, prefix := testEnvelopeGCM(t)
+	chunk := int64(1024)
+	sealed := int(chunk + envelopeOverhead)
+
+	data := make([]byte, 3*chunk+100) // 4 chunks, the last one short
+	rand.Read(data)
+	enc := encryptAll(t, aead, prefix, data, chunk)
+
+	tests := []struct {
+		name   string
+		mangle func([]byte) []byte
+	}{
+		{"flip a bit", func(b []byte) []byte {
+			b[sealed+10] ^= 1
+			return b
+		}},
+		{"flip a tag bit", func(b []byte) []byte {
+			b[2*sealed-1] ^= 1
+			return b
+		}},
+		{"swap chunks", func(b []byte) []byte {
+			res := append([]byte{}, b[sealed:2*sealed]...)
+			res = append(res, b[:sealed]...)
+			return append(res, b[2*sealed:]...)
+		}},
+		{"drop a chunk", func(b []byte) []byte {
+			return append(b[:sealed:sealed], b[2*sealed:]...)
+		}},
+		{"drop the last chunk", func(b []byte) []byte {
+			return b[:3*sealed]
+		}},
+		{"cut mid chunk", func(b []byte) []byte {
+			return b[:len(b)-10]
+		}},
+		{"cut to nothing", func(b []byte) []byte {
+			return b[:0]
+		}},
+		{"extra chunk", func(b []byte) []byte {
+			return append(b, b[:sealed]...)
+		}},
+		{"wrong prefix", func(b []byte) []byte {
+			prefix[0] ^= 1
+			return b
+		}},
+	}
+
+	for _, test := range tests {
+		orig := prefix[0]
+		mangled := test.mangle(append([]byte{}, enc...))
+		dec, err := ioutil.ReadAll(newDecryptReader(bytes.NewReader(mangled),
+			aead, prefix, chunk))
+		prefix[0] = orig
+		if err == nil {
+			t.Errorf("%s: decrypted %d bytes without an error", test.name,
+				len(dec))
+		}
+	}
+
+	// And the original is still fine
+	dec, err := ioutil.ReadAll(newDecryptReader(bytes.NewReader(enc), aead,
+		prefix, chunk))
+	if err != nil || !bytes.Equal(dec, data) {
+		t.Errorf("original didn't decrypt: %v", err)
+	}
+}
@@ -0,0 +1,303 @@
+package cosclient
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Sentinel errors for use with errors.Is(), e.g.:
+//
+//	if errors.Is(err, cosclient.ErrNoSuchKey) { ... }
+var (
+	ErrNotFound            = errors.New("not found") // Any 404
+	ErrNoSuchBucket        = errors.New("no such bucket")
+	ErrNoSuchKey           = errors.New("no such key")
+	ErrNoSuchUpload        = errors.New("no such upload")
+	ErrAccessDenied        = errors.New("access denied")
+	ErrBucketAlreadyExists = errors.New("bucket already exists")
+	ErrBucketNotEmpty      = errors.New("bucket not empty")
+	ErrPreconditionFailed  = errors.New("precondition failed")
+	ErrNotModified         = errors.New("not modified")
+	ErrInvalidRange        = errors.New("invalid range")
+	ErrSlowDown            = errors.New("slow down")
+	ErrInvalidTag          = errors.New("invalid tag")
+
+	ErrNoSuchLifecycleConfiguration = errors.New("no such lifecycle configuration")
+	ErrInvalidObjectState           = errors.New("invalid object state") // e.g. archived
+	ErrRestoreAlreadyInProgress     = errors.New("restore already in progress")
+	ErrObjectProtected              = errors.New("object protected") // Retention or legal hold
+	ErrNotEncrypted                 = errors.New("object is not client-side encrypted")
+	ErrNoCredentials                = errors.New("no credentials found")
+)
+
+// errorCodes maps the S3 error codes to our sentinel errors
+var errorCodes = map[string]error{
+	"NoSuchBucket":            ErrNoSuchBucket,
+	"NoSuchKey":               ErrNoSuchKey,
+	"NoSuchUpload":            ErrNoSuchUpload,
+	"AccessDenied":            ErrAccessDenied,
+	"BucketAlreadyExists":     ErrBucketAlreadyExists,
+	"BucketAlreadyOwnedByYou": ErrBucketAlreadyExists,
+	"BucketNotEmpty":          ErrBucketNotEmpty,
+	"PreconditionFailed":      ErrPreconditionFailed,
+	"NotModified":             ErrNotModified,
+	"InvalidRange":            ErrInvalidRange,
+	"SlowDown":                ErrSlowDown,
+	"InvalidTag":              ErrInvalidTag,
+
+	"NoSuchLifecycleConfiguration": ErrNoSuchLifecycleConfiguration,
+	"InvalidObjectState":           ErrInvalidObjectState,
+	"RestoreAlreadyInProgress":     ErrRestoreAlreadyInProgress,
+}
+
+// statusCodes is used to fill in the Code when there's no response body
+// to get it from, e.g. on a HEAD
+var statusCodes = map[int]string{
+	http.StatusNotModified:                  "NotModified",
+	http.StatusForbidden:                    "AccessDenied",
+	http.StatusPreconditionFailed:           "PreconditionFailed",
+	http.StatusRequestedRangeNotSatisfiable: "InvalidRange",
+}
+
+// Error is a failure reported by COS. It's parsed from the S3 <Error>
+// document in the response when there is one.
+type Error struct {
+	StatusCode   int
+	Code         string
+	Message      string
+	Resource     string
+	RequestID    string
+	IBMRequestID string // From the x-clv-request-id header
+
+	protectionHeaders bool // The response had retention/object lock headers
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Resource != "" {
+		msg += " (" + e.Resource + ")"
+	}
+	if e.RequestID != "" {
+		msg += " [" + e.RequestID + "]"
+	}
+	return msg
+}
+
+// Is lets errors.Is() compare an Error against the sentinel errors.
+func (e *Error) Is(target error) bool {
+	if target == ErrNotFound {
+		return e.StatusCode == http.StatusNotFound
+	}
+	if target == ErrObjectProtected {
+		return (e.Code == "AccessDenied" && e.protectionHeaders) ||
+			isProtected(e.Code, e.Message)
+	}
+	sentinel, ok := errorCodes[e.Code]
+	return ok && sentinel == target
+}
+
+// retryable returns true if the error is a transient one.
+func (e *Error) retryable() bool {
+	return isRetryableStatus(e.StatusCode) ||
+		e.Code == "RequestTimeout" || e.Code == "SlowDown" ||
+		e.Code == "InternalError"
+}
+
+// protectedKinds are the kinds of protection that show up in the message
+// of an AccessDenied that's due to the object's retention or legal holds,
+// e.g. "Access Denied because object protected by object lock."
+var protectedKinds = []string{"object lock", "retention", "legal hold"}
+
+// isProtected returns true if a failure was due to the object's retention
+// or legal holds. There's no specific code for it, it's an AccessDenied
+// and the message is only a hint, so it's matched loosely: "protected by"
+// and one of the protectedKinds.
+func isProtected(code, message string) bool {
+	if code != "AccessDenied" {
+		return false
+	}
+	message = strings.ToLower(message)
+	if !strings.Contains(message, "protected by") {
+		return false
+	}
+	for _, kind := range protectedKinds {
+		if strings.Contains(message, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasProtectionHeaders returns true if the response says the object is
+// under retention, object lock or legal hold.
+func hasProtectionHeaders(header http.Header) bool {
+	count, _ := strconv.Atoi(header.Get("Retention-Legal-Hold-Count"))
+	return header.Get("Retention-Expiration-Date") != "" || count > 0 ||
+		header.Get("x-amz-object-lock-mode") != "" ||
+		header.Get("x-amz-object-lock-retain-until-date") != "" ||
+		strings.EqualFold(header.Get("x-amz-object-lock-legal-hold"), "ON")
+}
+
+// newError builds an Error from a non-2xx response and its body.
+func newError(res *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: res.StatusCode}
+	parseError(body, e)
+
+	if e.Code == "" {
+		e.Code = statusCodes[res.StatusCode]
+		if e.Message == "" && len(body) > 0 {
+			e.Message = strings.TrimSpace(string(body))
+		}
+	}
+	if e.RequestID == "" {
+		e.RequestID = res.Header.Get("x-amz-request-id")
+	}
+	e.IBMRequestID = res.Header.Get("x-clv-request-id")
+	e.protectionHeaders = hasProtectionHeaders(res.Header)
+	return e
+}
+
+// parseError fills in 'e' from an S3 <Error> document and returns false
+// if 'body' isn't one.
+func parseError(body []byte, e *Error) bool {
+	// <Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Resource>/dugs/file3</Resource><RequestId>...</RequestId><httpStatusCode>404</httpStatusCode></Error>
+	doc := struct {
+		XMLName   xml.Name
+		Code      string
+		Message   string
+		Resource  string
+		RequestId string
+	}{}
+	if len(body) == 0 || xml.Unmarshal(body, &doc) != nil ||
+		doc.XMLName.Local != "Error" {
+		return false
+	}
+
+	e.Code = doc.Code
+	e.Message = doc.Message
+	e.Resource = doc.Resource
+	e.RequestID = doc.RequestId
+	return true
+}
+
+// DeleteError is the failure to delete one of the objects in a multi-object
+// delete.
+type DeleteError struct {
+	Key       string
+	VersionID string `xml:"VersionId"`
+	Code      string
+	Message   string
+}
+
+func (e *DeleteError) Error() string {
+	msg := e.Key
+	if e.VersionID != "" {
+		msg += "?versionId=" + e.VersionID
+	}
+	return msg + ": " + e.Code + ": " + e.Message
+}
+
+// Is compares the DeleteError against the sentinel errors, e.g.
+// ErrObjectProtected.
+func (e *DeleteError) Is(target error) bool {
+	return (&Error{Code: e.Code, Message: e.Message}).Is(target)
+}
+
+// DeleteObjectsError is returned when some of the objects in a multi-object
+// delete couldn't be deleted. The others were. errors.Is() is true if it's
+// true for any of the individual errors.
+type DeleteObjectsError struct {
+	Bucket string
+	Errors []DeleteError
+}
+
+func (e *DeleteObjectsError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("Error deleting objects from %s", e.Bucket)
+	}
+	return fmt.Sprintf("%d object(s) in %s could not be deleted, first: %s",
+		len(e.Errors), e.Bucket, e.Errors[0].Error())
+}
+
+func (e *DeleteObjectsError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i := range e.Errors {
+		errs[i] = &e.Errors[i]
+	}
+	return errs
+}
+
+// Protected returns the objects that couldn't be deleted because of their
+// retention or legal holds.
+func (e *DeleteObjectsError) Protected() []DeleteError {
+	res := []DeleteError{}
+	for _, delErr := range e.Errors {
+		if delErr.Is(ErrObjectProtected) {
+			res = append(res, delErr)
+		}
+	}
+	return res
+}
+
+// IAMError is a failure reported by IAM while getting a token.
+type IAMError struct {
+	StatusCode   int
+	ErrorCode    string
+	ErrorMessage string
+	RequestID    string
+}
+
+func (e *IAMError) Error() string {
+	msg := fmt.Sprintf("IAM: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	if e.ErrorCode != "" {
+		msg += ": " + e.ErrorCode
+	}
+	if e.ErrorMessage != "" {
+		msg += ": " + e.ErrorMessage
+	}
+	if e.RequestID != "" {
+		msg += " [" + e.RequestID + "]"
+	}
+	return msg
+}
+
+// Is treats IAM's 401/403s as ErrAccessDenied.
+func (e *IAMError) Is(target error) bool {
+	return target == ErrAccessDenied &&
+		(e.StatusCode == http.StatusUnauthorized ||
+			e.StatusCode == http.StatusForbidden)
+}
+
+func newIAMError(res *http.Response, body []byte) *IAMError {
+	// {"errorCode":"BXNIM0415E","errorMessage":"Provided API key could not be found.","context":{"requestId":"..."}}
+	doc := struct {
+		ErrorCode    string
+		ErrorMessage string
+		Context      struct {
+			RequestId string
+		}
+	}{}
+	json.Unmarshal(body, &doc)
+
+	e := &IAMError{
+		StatusCode:   res.StatusCode,
+		ErrorCode:    doc.ErrorCode,
+		ErrorMessage: doc.ErrorMessage,
+		RequestID:    doc.Context.RequestId,
+	}
+	if e.ErrorMessage == "" && len(body) > 0 {
+		e.ErrorMessage = strings.TrimSpace(string(body))
+	}
+	return e
+}
@@ -0,0 +1,302 @@
+package cosclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const xmlHeader = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>`
+
+// allSentinels is every sentinel that newError's results can match.
+var allSentinels = []error{
+	ErrNotFound, ErrNoSuchBucket, ErrNoSuchKey, ErrNoSuchUpload,
+	ErrAccessDenied, ErrBucketAlreadyExists, ErrBucketNotEmpty,
+	ErrPreconditionFailed, ErrNotModified, ErrInvalidRange, ErrSlowDown,
+	ErrInvalidTag, ErrNoSuchLifecycleConfiguration, ErrInvalidObjectState,
+	ErrRestoreAlreadyInProgress, ErrObjectProtected,
+}
+
+// checkSentinels makes sure 'err' matches exactly the sentinels in 'want'.
+func checkSentinels(t *testing.T, err error, want ...error) {
+	t.Helper()
+	for _, sentinel := range allSentinels {
+		expected := false
+		for _, w := range want {
+			expected = expected || w == sentinel
+		}
+		if errors.Is(err, sentinel) != expected {
+			t.Errorf("errors.Is(%q, %q) = %v, want %v", err, sentinel,
+				!expected, expected)
+		}
+	}
+}
+
+func TestNewError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		code    string
+		message string
+		reqID   string
+		want    []error
+	}{
+		{"NoSuchKey", 404, xmlHeader +
+			`<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Resource>/dugs/file3</Resource><RequestId>8c2c8d3b-cd36-4bd2-9b4f-4a6e2d7e0e8f</RequestId><httpStatusCode>404</httpStatusCode></Error>`,
+			"NoSuchKey", "The specified key does not exist.",
+			"8c2c8d3b-cd36-4bd2-9b4f-4a6e2d7e0e8f",
+			[]error{ErrNotFound, ErrNoSuchKey}},
+		{"NoSuchBucket", 404, xmlHeader +
+			`<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist.</Message><Resource>/nope/</Resource><RequestId>r1</RequestId><httpStatusCode>404</httpStatusCode></Error>`,
+			"NoSuchBucket", "The specified bucket does not exist.", "r1",
+			[]error{ErrNotFound, ErrNoSuchBucket}},
+		{"NoSuchUpload", 404,
+			`<Error><Code>NoSuchUpload</Code><Message>The specified multipart upload does not exist.</Message></Error>`,
+			"NoSuchUpload", "The specified multipart upload does not exist.", "hdr-id",
+			[]error{ErrNotFound, ErrNoSuchUpload}},
+		{"AccessDenied", 403,
+			`<Error><Code>AccessDenied</Code><Message>Access Denied</Message><RequestId>r2</RequestId></Error>`,
+			"AccessDenied", "Access Denied", "r2",
+			[]error{ErrAccessDenied}},
+		{"BucketAlreadyExists", 409,
+			`<Error><Code>BucketAlreadyExists</Code><Message>Container dugs exists</Message></Error>`,
+			"BucketAlreadyExists", "Container dugs exists", "hdr-id",
+			[]error{ErrBucketAlreadyExists}},
+		{"BucketNotEmpty", 409,
+			`<Error><Code>BucketNotEmpty</Code><Message>The bucket you tried to delete is not empty.</Message></Error>`,
+			"BucketNotEmpty", "The bucket you tried to delete is not empty.", "hdr-id",
+			[]error{ErrBucketNotEmpty}},
+		{"InvalidRange", 416,
+			`<Error><Code>InvalidRange</Code><Message>The requested range cannot be satisfied.</Message></Error>`,
+			"InvalidRange", "The requested range cannot be satisfied.", "hdr-id",
+			[]error{ErrInvalidRange}},
+		{"SlowDown", 503,
+			`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`,
+			"SlowDown", "Please reduce your request rate.", "hdr-id",
+			[]error{ErrSlowDown}},
+		{"InvalidObjectState", 403,
+			`<Error><Code>InvalidObjectState</Code><Message>The operation is not valid for the object's storage class</Message></Error>`,
+			"InvalidObjectState", "The operation is not valid for the object's storage class", "hdr-id",
+			[]error{ErrInvalidObjectState}},
+		{"NoSuchLifecycleConfiguration", 404,
+			`<Error><Code>NoSuchLifecycleConfiguration</Code><Message>The lifecycle configuration does not exist</Message></Error>`,
+			"NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist", "hdr-id",
+			[]error{ErrNotFound, ErrNoSuchLifecycleConfiguration}},
+
+		// HEADs have no body, so all we have is the status
+		{"HEAD 404", 404, "", "", "", "hdr-id", []error{ErrNotFound}},
+		{"HEAD 403", 403, "", "AccessDenied", "", "hdr-id",
+			[]error{ErrAccessDenied}},
+		{"HEAD 304", 304, "", "NotModified", "", "hdr-id",
+			[]error{ErrNotModified}},
+		{"HEAD 412", 412, "", "PreconditionFailed", "", "hdr-id",
+			[]error{ErrPreconditionFailed}},
+		{"HEAD 500", 500, "", "", "", "hdr-id", nil},
+
+		// Not from COS itself, e.g. a proxy in the way
+		{"HTML", 502, "<html><body>Bad Gateway</body></html>", "",
+			"<html><body>Bad Gateway</body></html>", "hdr-id", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			res.Header.Set("x-amz-request-id", "hdr-id")
+			res.Header.Set("x-clv-request-id", "clv-id")
+
+			e := newError(res, []byte(test.body))
+			if e.StatusCode != test.status || e.Code != test.code ||
+				e.Message != test.message || e.RequestID != test.reqID ||
+				e.IBMRequestID != "clv-id" {
+				t.Errorf("newError() = %#v", e)
+			}
+
+			checkSentinels(t, e, test.want...)
+
+			// And still once it's been wrapped
+			checkSentinels(t, fmt.Errorf("GET error(/b/k): %w", e), test.want...)
+		})
+	}
+}
+
+func TestParseErrorNotXML(t *testing.T) {
+	for _, body := range []string{"", "junk", `{"code":"x"}`,
+		`<Other><Code>NoSuchKey</Code></Other>`} {
+
+		e := &Error{}
+		if parseError([]byte(body), e) || e.Code != "" {
+			t.Errorf("parseError(%q) = true, %#v", body, e)
+		}
+	}
+}
+
+func TestNewIAMError(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		code    string
+		message string
+		reqID   string
+		denied  bool
+	}{
+		{"bad apikey", 400,
+			`{"errorCode":"BXNIM0415E","errorMessage":"Provided API key could not be found.","context":{"requestId":"req-1"}}`,
+			"BXNIM0415E", "Provided API key could not be found.", "req-1", false},
+		{"unauthorized", 401,
+			`{"errorCode":"BXNIM0109E","errorMessage":"Property missing or empty.","context":{"requestId":"req-2"}}`,
+			"BXNIM0109E", "Property missing or empty.", "req-2", true},
+		{"forbidden", 403, `{"errorCode":"BXNIM0513E","errorMessage":"You are not authorized."}`,
+			"BXNIM0513E", "You are not authorized.", "", true},
+		{"empty", 401, "", "", "", "", true},
+		{"not json", 500, "oops", "", "oops", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: test.status, Header: http.Header{}}
+			e := newIAMError(res, []byte(test.body))
+			if e.StatusCode != test.status || e.ErrorCode != test.code ||
+				e.ErrorMessage != test.message || e.RequestID != test.reqID {
+				t.Errorf("newIAMError() = %#v", e)
+			}
+			if errors.Is(e, ErrAccessDenied) != test.denied {
+				t.Errorf("errors.Is(ErrAccessDenied) = %v", !test.denied)
+			}
+			if errors.Is(e, ErrNotFound) {
+				t.Errorf("errors.Is(ErrNotFound) = true")
+			}
+		})
+	}
+}
+
+func TestHeadObjectNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	_, err := client.HeadObject(context.Background(), "b", "k")
+	checkSentinels(t, err, ErrNotFound)
+}
+
+func TestIsProtected(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		header    map[string]string
+		body      string
+		protected bool
+	}{
+		{"object lock", 403, nil, xmlHeader +
+			`<Error><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock.</Message><Resource>/worm/file1</Resource><RequestId>r1</RequestId><httpStatusCode>403</httpStatusCode></Error>`,
+			true},
+		{"object lock no period", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>access denied because object protected by object lock</Message></Error>`,
+			true},
+		{"retention", 403, nil, xmlHeader +
+			`<Error><Code>AccessDenied</Code><Message>Access Denied because object protected by retention.</Message><Resource>/worm/file1</Resource><RequestId>r3</RequestId><httpStatusCode>403</httpStatusCode></Error>`,
+			true},
+		{"legal hold", 403, nil, xmlHeader +
+			`<Error><Code>AccessDenied</Code><Message>Access Denied because object protected by legal hold.</Message><Resource>/worm/file1</Resource><RequestId>r4</RequestId><httpStatusCode>403</httpStatusCode></Error>`,
+			true},
+		{"plain access denied", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>Access Denied</Message><Resource>/worm/file1</Resource><RequestId>r2</RequestId></Error>`,
+			false},
+		// These used to match because of "lock" or "protect"
+		{"blocked", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>Access Denied: request blocked by the bucket's firewall</Message></Error>`,
+			false},
+		{"public access block", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>Public access is blocked for this bucket</Message></Error>`,
+			false},
+		{"protected by key", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>Object is protected by a Key Protect root key you don't have access to</Message></Error>`,
+			false},
+		{"other code", 400, nil,
+			`<Error><Code>InvalidRequest</Code><Message>Access Denied because object protected by object lock.</Message></Error>`,
+			false},
+		{"HEAD", 403, nil, "", false},
+		// The message is only a hint, other wordings still match
+		{"reworded retention", 403, nil, xmlHeader +
+			`<Error><Code>AccessDenied</Code><Message>Access denied: the object is protected by a retention policy</Message><Resource>/worm/file1</Resource><RequestId>r5</RequestId><httpStatusCode>403</httpStatusCode></Error>`,
+			true},
+		{"reworded legal hold", 403, nil,
+			`<Error><Code>AccessDenied</Code><Message>Object Protected By Legal Hold</Message></Error>`,
+			true},
+		// The headers say it's protected whatever the message
+		{"HEAD retention", 403,
+			map[string]string{"Retention-Expiration-Date": "Fri, 01 Jan 2100 00:00:00 GMT"},
+			"", true},
+		{"legal hold count", 403,
+			map[string]string{"Retention-Legal-Hold-Count": "2"},
+			`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`,
+			true},
+		{"object lock mode", 403,
+			map[string]string{"x-amz-object-lock-mode": "COMPLIANCE"},
+			`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`,
+			true},
+		{"no holds", 403,
+			map[string]string{"Retention-Legal-Hold-Count": "0",
+				"x-amz-object-lock-legal-hold": "OFF"},
+			`<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>`,
+			false},
+		{"headers but not denied", 404,
+			map[string]string{"x-amz-object-lock-mode": "COMPLIANCE"},
+			`<Error><Code>NoSuchKey</Code></Error>`,
+			false},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{StatusCode: test.status, Header: http.Header{}}
+		for k, v := range test.header {
+			res.Header.Set(k, v)
+		}
+		err := newError(res, []byte(test.body))
+		if errors.Is(err, ErrObjectProtected) != test.protected {
+			t.Errorf("%s: errors.Is(ErrObjectProtected) = %v", test.name,
+				!test.protected)
+		}
+	}
+}
+
+func TestDeleteObjectsProtected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(xmlHeader + `<DeleteResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+			`<Deleted><Key>file1</Key></Deleted>` +
+			`<Error><Key>file2</Key><VersionId>v2</VersionId><Code>AccessDenied</Code><Message>Access Denied because object protected by object lock.</Message></Error>` +
+			`<Error><Key>file3</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>` +
+			`</DeleteResult>`))
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	err := client.DeleteObjectVersions(context.Background(), "b",
+		[]ObjectIdentifier{{Key: "file1"}, {Key: "file2", VersionID: "v2"},
+			{Key: "file3"}})
+
+	delErr := (*DeleteObjectsError)(nil)
+	if !errors.As(err, &delErr) {
+		t.Fatalf("err = %v, want a DeleteObjectsError", err)
+	}
+	if len(delErr.Errors) != 2 {
+		t.Fatalf("got %d errors, want 2", len(delErr.Errors))
+	}
+	protected := delErr.Protected()
+	if len(protected) != 1 || protected[0].Key != "file2" ||
+		protected[0].VersionID != "v2" {
+		t.Errorf("Protected() = %+v", protected)
+	}
+	if !errors.Is(err, ErrObjectProtected) || !errors.Is(err, ErrAccessDenied) {
+		t.Errorf("errors.Is() doesn't see the individual errors")
+	}
+}
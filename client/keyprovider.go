@@ -0,0 +1,117 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// LocalKeyAlgorithm is how LocalKeyProvider wraps data keys.
+const LocalKeyAlgorithm = "AES256-GCM"
+
+// LocalKeyProvider wraps data keys with a 256 bit master key held in
+// memory, typically read from a keyfile. Meant for tests and for setups
+// that don't have a KMS; losing the keyfile means losing the data.
+type LocalKeyProvider struct {
+	KeyID string // Defaults to a fingerprint of the key
+
+	aead cipher.AEAD
+}
+
+// NewLocalKeyProvider returns a LocalKeyProvider for the 32 byte 'key'.
+func NewLocalKeyProvider(key []byte) (*LocalKeyProvider, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Master key must be 32 bytes, not %d", len(key))
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &LocalKeyProvider{
+		KeyID: "local:" + hex.EncodeToString(sum[:8]),
+		aead:  aead,
+	}, nil
+}
+
+// LoadLocalKeyProvider reads the master key from 'path', which holds
+// either the 32 raw bytes of the key or the key base64 encoded.
+func LoadLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading keyfile: %w", err)
+	}
+	if len(buf) != 32 {
+		buf, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding keyfile %q: %w", path, err)
+		}
+	}
+	return NewLocalKeyProvider(buf)
+}
+
+// CreateLocalKeyFile writes a new random master key, base64 encoded, to
+// 'path'. It won't overwrite an existing file.
+func CreateLocalKeyFile(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return fmt.Errorf("Error generating key: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Error creating keyfile: %w", err)
+	}
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing keyfile: %w", err)
+	}
+	return nil
+}
+
+// WrapKey encrypts 'dataKey' with the master key. The result is the nonce
+// followed by the sealed key.
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, dataKey []byte) (*WrappedKey, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("Error generating nonce: %w", err)
+	}
+	return &WrappedKey{
+		Key:       p.aead.Seal(nonce, nonce, dataKey, []byte(p.KeyID)),
+		KeyID:     p.KeyID,
+		Algorithm: LocalKeyAlgorithm,
+	}, nil
+}
+
+// UnwrapKey decrypts a key wrapped by WrapKey.
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, key *WrappedKey) ([]byte, error) {
+	if key.Algorithm != LocalKeyAlgorithm {
+		return nil, fmt.Errorf("Unsupported key wrapping algorithm %q",
+			key.Algorithm)
+	}
+	if key.KeyID != p.KeyID {
+		return nil, fmt.Errorf("Data key was wrapped with key %q, not %q",
+			key.KeyID, p.KeyID)
+	}
+
+	size := p.aead.NonceSize()
+	if len(key.Key) < size {
+		return nil, fmt.Errorf("Wrapped key is too short")
+	}
+	dataKey, err := p.aead.Open(nil, key.Key[:size], key.Key[size:],
+		[]byte(p.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("Error unwrapping data key: %w", err)
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,162 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+)
+
+// https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-archive
+// https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-expiry
+
+// Storage classes that objects can be transitioned to.
+const (
+	StorageClassArchive            = "GLACIER"
+	StorageClassAcceleratedArchive = "ACCELERATED"
+)
+
+// Lifecycle rule states.
+const (
+	LifecycleEnabled  = "Enabled"
+	LifecycleDisabled = "Disabled"
+)
+
+// LifecycleConfiguration is the S3 <LifecycleConfiguration> document. All
+// optional elements are pointers so that what's read from the server is
+// written back out exactly the same way.
+type LifecycleConfiguration struct {
+	XMLName xml.Name        `xml:"LifecycleConfiguration"`
+	Xmlns   string          `xml:"xmlns,attr,omitempty"` // Kept as returned
+	Rules   []LifecycleRule `xml:"Rule"`
+}
+
+type LifecycleRule struct {
+	ID                             string                          `xml:"ID,omitempty"`
+	Prefix                         *string                         `xml:"Prefix,omitempty"` // Legacy, use Filter
+	Filter                         *LifecycleFilter                `xml:"Filter,omitempty"`
+	Status                         string                          `xml:"Status"` // Enabled or Disabled
+	Transitions                    []Transition                    `xml:"Transition,omitempty"`
+	Expiration                     *Expiration                     `xml:"Expiration,omitempty"`
+	NoncurrentVersionExpiration    *NoncurrentVersionExpiration    `xml:"NoncurrentVersionExpiration,omitempty"`
+	AbortIncompleteMultipartUpload *AbortIncompleteMultipartUpload `xml:"AbortIncompleteMultipartUpload,omitempty"`
+}
+
+// LifecycleFilter picks the objects a rule applies to. Use at most one of
+// Prefix, Tag or And. An empty filter matches every object.
+type LifecycleFilter struct {
+	Prefix *string       `xml:"Prefix,omitempty"`
+	Tag    *Tag          `xml:"Tag,omitempty"`
+	And    *LifecycleAnd `xml:"And,omitempty"`
+}
+
+// LifecycleAnd matches objects that have the prefix and all of the tags.
+type LifecycleAnd struct {
+	Prefix *string `xml:"Prefix,omitempty"`
+	Tags   []Tag   `xml:"Tag,omitempty"`
+}
+
+// Transition moves objects to another storage class, e.g.
+// StorageClassArchive, either a number of days after creation or on a
+// specific date.
+type Transition struct {
+	Days         *int    `xml:"Days,omitempty"`
+	Date         *string `xml:"Date,omitempty"` // ISO 8601, midnight UTC
+	StorageClass string  `xml:"StorageClass"`
+}
+
+// Expiration deletes objects a number of days after creation or on a
+// specific date.
+type Expiration struct {
+	Days                      *int    `xml:"Days,omitempty"`
+	Date                      *string `xml:"Date,omitempty"` // ISO 8601, midnight UTC
+	ExpiredObjectDeleteMarker *bool   `xml:"ExpiredObjectDeleteMarker,omitempty"`
+}
+
+// NoncurrentVersionExpiration deletes old versions once they've been
+// noncurrent for NoncurrentDays.
+type NoncurrentVersionExpiration struct {
+	NoncurrentDays int `xml:"NoncurrentDays"`
+}
+
+// AbortIncompleteMultipartUpload cleans up multipart uploads that were
+// never completed.
+type AbortIncompleteMultipartUpload struct {
+	DaysAfterInitiation int `xml:"DaysAfterInitiation"`
+}
+
+// GetBucketLifecycle returns the bucket's lifecycle rules. If there are
+// none the error matches ErrNoSuchLifecycleConfiguration.
+func (client *COSClient) GetBucketLifecycle(ctx context.Context, bucket string) (*LifecycleConfiguration, error) {
+	// GET /bucket?lifecycle
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s?lifecycle", svcURL, bucket)
+
+	body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	config := &LifecycleConfiguration{}
+	if err = xml.Unmarshal(body, config); err != nil {
+		return nil, fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	return config, nil
+}
+
+// PutBucketLifecycle replaces all of the bucket's lifecycle rules.
+func (client *COSClient) PutBucketLifecycle(ctx context.Context, bucket string, config *LifecycleConfiguration) error {
+	// PUT /bucket?lifecycle
+
+	if config == nil || len(config.Rules) == 0 {
+		return fmt.Errorf("Missing lifecycle rules, use DeleteBucketLifecycle to remove them")
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s?lifecycle", svcURL, bucket)
+
+	body, err := xml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(body)
+	headers := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+
+	_, err = client.doHTTP(ctx, "PUT", path, body, 1, headers)
+	if err != nil {
+		err = fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	return err
+}
+
+// DeleteBucketLifecycle removes all of the bucket's lifecycle rules.
+func (client *COSClient) DeleteBucketLifecycle(ctx context.Context, bucket string) error {
+	// DELETE /bucket?lifecycle
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s?lifecycle", svcURL, bucket)
+
+	_, err = client.doHTTP(ctx, "DELETE", path, nil, 1, nil)
+	if err != nil {
+		err = fmt.Errorf("DELETE error(%s): %w", path, err)
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package cosclient
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestLifecycleRoundTrip(t *testing.T) {
+	// As returned by GET /bucket?lifecycle, minus the whitespace and the
+	// xmlns (see below)
+	doc := `<LifecycleConfiguration>` +
+		`<Rule>` +
+		`<ID>archive</ID>` +
+		`<Filter><Prefix></Prefix></Filter>` +
+		`<Status>Enabled</Status>` +
+		`<Transition><Days>30</Days><StorageClass>GLACIER</StorageClass></Transition>` +
+		`</Rule>` +
+		`<Rule>` +
+		`<ID>expire-logs</ID>` +
+		`<Filter><Prefix>logs/</Prefix></Filter>` +
+		`<Status>Enabled</Status>` +
+		`<Expiration><Date>2030-01-01T00:00:00.000Z</Date></Expiration>` +
+		`</Rule>` +
+		`<Rule>` +
+		`<ID>tmp</ID>` +
+		`<Filter><And><Prefix>tmp/</Prefix><Tag><Key>scratch</Key><Value>true</Value></Tag><Tag><Key>env</Key><Value>dev</Value></Tag></And></Filter>` +
+		`<Status>Disabled</Status>` +
+		`<Transition><Date>2029-06-01T00:00:00.000Z</Date><StorageClass>ACCELERATED</StorageClass></Transition>` +
+		`<Expiration><Days>0</Days></Expiration>` +
+		`<NoncurrentVersionExpiration><NoncurrentDays>7</NoncurrentDays></NoncurrentVersionExpiration>` +
+		`</Rule>` +
+		`<Rule>` +
+		`<ID>uploads</ID>` +
+		`<Filter><Tag><Key>kind</Key><Value>upload</Value></Tag></Filter>` +
+		`<Status>Enabled</Status>` +
+		`<Expiration><ExpiredObjectDeleteMarker>true</ExpiredObjectDeleteMarker></Expiration>` +
+		`<AbortIncompleteMultipartUpload><DaysAfterInitiation>3</DaysAfterInitiation></AbortIncompleteMultipartUpload>` +
+		`</Rule>` +
+		`</LifecycleConfiguration>`
+
+	config := &LifecycleConfiguration{}
+	if err := xml.Unmarshal([]byte(doc), config); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+
+	if len(config.Rules) != 4 {
+		t.Fatalf("got %d rules, want 4", len(config.Rules))
+	}
+	rule := config.Rules[0]
+	if rule.Filter == nil || rule.Filter.Prefix == nil || *rule.Filter.Prefix != "" ||
+		len(rule.Transitions) != 1 || *rule.Transitions[0].Days != 30 ||
+		rule.Transitions[0].StorageClass != StorageClassArchive {
+		t.Errorf("rule 0: %+v", rule)
+	}
+	rule = config.Rules[2]
+	if rule.Status != LifecycleDisabled || rule.Filter.And == nil ||
+		len(rule.Filter.And.Tags) != 2 || rule.Expiration == nil ||
+		rule.Expiration.Days == nil || *rule.Expiration.Days != 0 {
+		t.Errorf("rule 2: %+v", rule)
+	}
+	rule = config.Rules[3]
+	if rule.AbortIncompleteMultipartUpload == nil ||
+		rule.AbortIncompleteMultipartUpload.DaysAfterInitiation != 3 {
+		t.Errorf("rule 3: %+v", rule)
+	}
+
+	buf, err := xml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if string(buf) != doc {
+		t.Errorf("round trip mismatch:\ngot:  %s\nwant: %s", buf, doc)
+	}
+
+	// COS's response has the S3 namespace, it's written back out as is
+	nsDoc := strings.Replace(doc, "<LifecycleConfiguration>",
+		`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`, 1)
+	config = &LifecycleConfiguration{}
+	if err := xml.Unmarshal([]byte(nsDoc), config); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if buf, _ = xml.Marshal(config); string(buf) != nsDoc {
+		t.Errorf("round trip mismatch:\ngot:  %s\nwant: %s", buf, nsDoc)
+	}
+}
+
+func TestLifecycleLegacyRoundTrip(t *testing.T) {
+	// Rules created before <Filter> existed have the Prefix directly in
+	// the <Rule>
+	doc := `<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+		`<Rule>` +
+		`<ID>old-archive</ID>` +
+		`<Prefix>backups/</Prefix>` +
+		`<Status>Enabled</Status>` +
+		`<Transition><Days>90</Days><StorageClass>GLACIER</StorageClass></Transition>` +
+		`</Rule>` +
+		`<Rule>` +
+		`<ID>old-all</ID>` +
+		`<Prefix></Prefix>` +
+		`<Status>Enabled</Status>` +
+		`<Expiration><Days>365</Days></Expiration>` +
+		`</Rule>` +
+		`</LifecycleConfiguration>`
+
+	config := &LifecycleConfiguration{}
+	if err := xml.Unmarshal([]byte(doc), config); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+
+	if config.Xmlns != "http://s3.amazonaws.com/doc/2006-03-01/" {
+		t.Errorf("xmlns: %q", config.Xmlns)
+	}
+	if len(config.Rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(config.Rules))
+	}
+	rule := config.Rules[0]
+	if rule.Prefix == nil || *rule.Prefix != "backups/" || rule.Filter != nil {
+		t.Errorf("rule 0: %+v", rule)
+	}
+	rule = config.Rules[1]
+	if rule.Prefix == nil || *rule.Prefix != "" || rule.Filter != nil {
+		t.Errorf("rule 1: %+v", rule)
+	}
+
+	buf, err := xml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Marshal: %s", err)
+	}
+	if string(buf) != doc {
+		t.Errorf("round trip mismatch:\ngot:  %s\nwant: %s", buf, doc)
+	}
+}
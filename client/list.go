@@ -0,0 +1,213 @@
+package cosclient
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ListObjectsOptions holds the optional settings for ListObjectsV2.
+type ListObjectsOptions struct {
+	Prefix            string
+	Delimiter         string // Usually "/", groups keys into CommonPrefixes
+	StartAfter        string
+	ContinuationToken string // From a previous ListObjectsResult
+	MaxKeys           int    // Zero means the server's default (1000)
+	FetchOwner        bool
+
+	// EncodingType "url" has the server URL encode the keys in the
+	// response, needed for keys with characters that XML can't carry.
+	// They're decoded before being returned.
+	EncodingType string
+}
+
+// ListObjectsResult is one page of a ListObjectsV2 call.
+type ListObjectsResult struct {
+	Name                  string
+	Prefix                string
+	Delimiter             string
+	StartAfter            string
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	ContinuationToken     string
+	NextContinuationToken string // Pass back in to get the next page
+
+	Objects        []ObjectMetadata
+	CommonPrefixes []string
+}
+
+// ListObjectsV2 returns one page of the objects in 'bucket'. To get the
+// next page pass NextContinuationToken back in as the ContinuationToken.
+func (client *COSClient) ListObjectsV2(ctx context.Context, bucket string, opts *ListObjectsOptions) (*ListObjectsResult, error) {
+	// GET /bucket?list-type=2
+
+	if opts == nil {
+		opts = &ListObjectsOptions{}
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		query.Set("delimiter", opts.Delimiter)
+	}
+	if opts.StartAfter != "" {
+		query.Set("start-after", opts.StartAfter)
+	}
+	if opts.ContinuationToken != "" {
+		query.Set("continuation-token", opts.ContinuationToken)
+	}
+	if opts.MaxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(opts.MaxKeys))
+	}
+	if opts.FetchOwner {
+		query.Set("fetch-owner", "true")
+	}
+	if opts.EncodingType != "" {
+		query.Set("encoding-type", opts.EncodingType)
+	}
+
+	path := fmt.Sprintf("%s/%s?%s", svcURL, bucket, query.Encode())
+
+	body, err := client.doHTTP(ctx, "GET", path, nil, 2, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	objects := ObjectListResponse{}
+	if err = xml.Unmarshal(body, &objects); err != nil {
+		return nil, fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	decode := func(str string) string { return str }
+	if objects.EncodingType == "url" {
+		decode = func(str string) string {
+			if res, err := url.QueryUnescape(str); err == nil {
+				return res
+			}
+			return str
+		}
+	}
+
+	res := &ListObjectsResult{
+		Name:                  objects.Name,
+		Prefix:                decode(objects.Prefix),
+		Delimiter:             decode(objects.Delimiter),
+		StartAfter:            decode(objects.StartAfter),
+		MaxKeys:               objects.MaxKeys,
+		KeyCount:              objects.KeyCount,
+		IsTruncated:           objects.IsTruncated,
+		ContinuationToken:     objects.ContinuationToken,
+		NextContinuationToken: objects.NextContinuationToken,
+		Objects:               objects.Contents,
+	}
+	for i := range res.Objects {
+		res.Objects[i].Key = decode(res.Objects[i].Key)
+	}
+	for _, prefix := range objects.CommonPrefixes {
+		res.CommonPrefixes = append(res.CommonPrefixes, decode(prefix.Prefix))
+	}
+
+	return res, nil
+}
+
+// ObjectIterator walks the objects in a bucket one page at a time, only
+// fetching the next page once the current one has been used up. Use it
+// like:
+//
+//	it := client.Objects(ctx, bucket, nil)
+//	for it.Next() {
+//		obj := it.Object()
+//		...
+//	}
+//	if err := it.Err(); err != nil { ... }
+type ObjectIterator struct {
+	client *COSClient
+	ctx    context.Context
+	bucket string
+	opts   ListObjectsOptions
+
+	page []ObjectMetadata
+	obj  ObjectMetadata
+	done bool
+	err  error
+}
+
+// Objects returns an iterator over the objects in 'bucket'. Any
+// ContinuationToken in 'opts' is used as the starting point. Common
+// prefixes are not returned, use ListObjectsV2 for those.
+func (client *COSClient) Objects(ctx context.Context, bucket string, opts *ListObjectsOptions) *ObjectIterator {
+	it := &ObjectIterator{
+		client: client,
+		ctx:    ctx,
+		bucket: bucket,
+	}
+	if opts != nil {
+		it.opts = *opts
+	}
+	return it
+}
+
+// Next moves to the next object, returning false when there are no more
+// or an error occurred. It also stops once the context is done, even in
+// the middle of a page.
+func (it *ObjectIterator) Next() bool {
+	if it.err == nil {
+		it.err = it.ctx.Err()
+	}
+	if it.err != nil {
+		return false
+	}
+
+	for len(it.page) == 0 {
+		if it.done {
+			return false
+		}
+
+		res, err := it.client.ListObjectsV2(it.ctx, it.bucket, &it.opts)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if res.IsTruncated && res.NextContinuationToken == "" {
+			// Stopping here would look like the end of the bucket
+			it.err = fmt.Errorf("Listing of %s is truncated but has no continuation token",
+				it.bucket)
+			return false
+		}
+
+		it.page = res.Objects
+		it.done = !res.IsTruncated
+		it.opts.ContinuationToken = res.NextContinuationToken
+	}
+
+	it.obj = it.page[0]
+	it.page = it.page[1:]
+	return true
+}
+
+// Object returns the current object.
+func (it *ObjectIterator) Object() ObjectMetadata {
+	return it.obj
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (it *ObjectIterator) Err() error {
+	return it.err
+}
+
+// ContinuationToken returns the token for the page after the current one
+// so a later walk can pick up from there.
+func (it *ObjectIterator) ContinuationToken() string {
+	return it.opts.ContinuationToken
+}
@@ -0,0 +1,280 @@
+package cosclient
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeBucket serves ListObjectsV2 for 'keys', which must be sorted. The
+// continuation token is just the last key, or common prefix, returned.
+type fakeBucket struct {
+	*httptest.Server
+	keys   []string
+	tokens []string // continuation-token of each request
+	fail   int32    // Fail request # 'fail', if not zero
+	reqs   int32
+}
+
+func newFakeBucket(t *testing.T, keys []string) *fakeBucket {
+	b := &fakeBucket{keys: keys}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&b.reqs, 1)
+		if n == atomic.LoadInt32(&b.fail) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<Error><Code>InternalError</Code></Error>"))
+			return
+		}
+
+		q := r.URL.Query()
+		b.tokens = append(b.tokens, q.Get("continuation-token"))
+		prefix, delim := q.Get("prefix"), q.Get("delimiter")
+		maxKeys, _ := strconv.Atoi(q.Get("max-keys"))
+		if maxKeys == 0 {
+			maxKeys = 1000
+		}
+		after := q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			after = token
+		}
+
+		res := ObjectListResponse{
+			Name:              "b",
+			Prefix:            prefix,
+			Delimiter:         delim,
+			MaxKeys:           maxKeys,
+			ContinuationToken: q.Get("continuation-token"),
+		}
+		last := ""
+		for _, key := range b.keys {
+			if !strings.HasPrefix(key, prefix) || key <= after ||
+				(strings.HasSuffix(after, delim) && delim != "" &&
+					strings.HasPrefix(key, after)) {
+				continue
+			}
+			item := key
+			if i := strings.Index(key[len(prefix):], delim); delim != "" && i >= 0 {
+				item = key[:len(prefix)+i+len(delim)]
+				if item == last {
+					continue
+				}
+			}
+			if res.KeyCount == maxKeys {
+				res.IsTruncated = true
+				res.NextContinuationToken = last
+				break
+			}
+			if item == key {
+				res.Contents = append(res.Contents,
+					ObjectMetadata{Key: key, Size: int64(len(key))})
+			} else {
+				res.CommonPrefixes = append(res.CommonPrefixes,
+					struct{ Prefix string }{item})
+			}
+			res.KeyCount++
+			last = item
+		}
+
+		buf, _ := xml.Marshal(res)
+		w.Write(buf)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func newListClient(t *testing.T, b *fakeBucket) *COSClient {
+	client := newTestClient(t, WithRetryPolicy(NoRetries))
+	client.Endpoints = map[string]string{"b": b.URL}
+	return client
+}
+
+func TestListObjectsV2Pages(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"}
+	b := newFakeBucket(t, keys)
+	client := newListClient(t, b)
+
+	got := []string{}
+	opts := &ListObjectsOptions{MaxKeys: 3}
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("too many pages")
+		}
+		res, err := client.ListObjectsV2(context.Background(), "b", opts)
+		if err != nil {
+			t.Fatalf("ListObjectsV2: %s", err)
+		}
+		for _, obj := range res.Objects {
+			got = append(got, obj.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		if res.NextContinuationToken == "" {
+			t.Fatalf("truncated page with no NextContinuationToken")
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+
+	if !reflect.DeepEqual(got, keys) {
+		t.Errorf("keys = %q, want %q", got, keys)
+	}
+	if want := []string{"", "c", "f"}; !reflect.DeepEqual(b.tokens, want) {
+		t.Errorf("continuation tokens sent = %q, want %q", b.tokens, want)
+	}
+}
+
+func TestListObjectsV2Delimiter(t *testing.T) {
+	b := newFakeBucket(t, []string{
+		"logs/2020/a", "logs/2020/b", "logs/2021/a", "logs/top", "other/x",
+		"readme",
+	})
+	client := newListClient(t, b)
+
+	tests := []struct {
+		prefix   string
+		objects  []string
+		prefixes []string
+	}{
+		{"", []string{"readme"}, []string{"logs/", "other/"}},
+		{"logs/", []string{"logs/top"}, []string{"logs/2020/", "logs/2021/"}},
+		{"logs/2020/", []string{"logs/2020/a", "logs/2020/b"}, nil},
+	}
+
+	for _, test := range tests {
+		res, err := client.ListObjectsV2(context.Background(), "b",
+			&ListObjectsOptions{Prefix: test.prefix, Delimiter: "/"})
+		if err != nil {
+			t.Fatalf("%q: ListObjectsV2: %s", test.prefix, err)
+		}
+		objects := []string(nil)
+		for _, obj := range res.Objects {
+			objects = append(objects, obj.Key)
+		}
+		if !reflect.DeepEqual(objects, test.objects) ||
+			!reflect.DeepEqual(res.CommonPrefixes, test.prefixes) {
+			t.Errorf("%q: got %q and %q, want %q and %q", test.prefix,
+				objects, res.CommonPrefixes, test.objects, test.prefixes)
+		}
+	}
+
+	// Common prefixes count towards MaxKeys and page like keys do
+	got := []string{}
+	opts := &ListObjectsOptions{Delimiter: "/", MaxKeys: 1}
+	for {
+		res, err := client.ListObjectsV2(context.Background(), "b", opts)
+		if err != nil {
+			t.Fatalf("ListObjectsV2: %s", err)
+		}
+		got = append(got, res.CommonPrefixes...)
+		for _, obj := range res.Objects {
+			got = append(got, obj.Key)
+		}
+		if !res.IsTruncated {
+			break
+		}
+		opts.ContinuationToken = res.NextContinuationToken
+	}
+	if want := []string{"logs/", "other/", "readme"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paged with delimiter = %q, want %q", got, want)
+	}
+}
+
+func TestObjectIterator(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g"}
+	b := newFakeBucket(t, keys)
+	client := newListClient(t, b)
+
+	got := []string{}
+	it := client.Objects(context.Background(), "b", &ListObjectsOptions{MaxKeys: 2})
+	for it.Next() {
+		got = append(got, it.Object().Key)
+		// Pages are only fetched as needed
+		if want := int32((len(got) + 1) / 2); b.reqs != want {
+			t.Errorf("after %d objects made %d requests, want %d", len(got),
+				b.reqs, want)
+		}
+	}
+	if it.Err() != nil || !reflect.DeepEqual(got, keys) {
+		t.Errorf("got %q, %v", got, it.Err())
+	}
+}
+
+func TestObjectIteratorCancel(t *testing.T) {
+	b := newFakeBucket(t, []string{"a", "b", "c", "d", "e", "f", "g"})
+	client := newListClient(t, b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	it := client.Objects(ctx, "b", &ListObjectsOptions{MaxKeys: 3})
+	count := 0
+	for it.Next() {
+		if count++; count == 2 {
+			cancel() // In the middle of the first page
+		}
+	}
+	if count != 2 || it.Err() != context.Canceled {
+		t.Errorf("got %d objects, %v; want 2, context.Canceled", count, it.Err())
+	}
+	if b.reqs != 1 {
+		t.Errorf("made %d requests, want 1", b.reqs)
+	}
+}
+
+func TestObjectIteratorPageError(t *testing.T) {
+	b := newFakeBucket(t, []string{"a", "b", "c", "d", "e", "f", "g"})
+	b.fail = 2
+	client := newListClient(t, b)
+
+	count := 0
+	it := client.Objects(context.Background(), "b", &ListObjectsOptions{MaxKeys: 3})
+	for it.Next() {
+		count++
+	}
+	cosErr := (*Error)(nil)
+	if count != 3 || !errors.As(it.Err(), &cosErr) || cosErr.StatusCode != 500 {
+		t.Errorf("got %d objects, %v; want 3 and a 500", count, it.Err())
+	}
+
+	// A truncated page without a token mustn't look like the end
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<ListBucketResult><IsTruncated>true</IsTruncated>" +
+			"<Contents><Key>a</Key></Contents></ListBucketResult>"))
+	}))
+	defer srv.Close()
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	count = 0
+	it = client.Objects(context.Background(), "b", nil)
+	for it.Next() {
+		count++
+	}
+	if count != 0 || it.Err() == nil {
+		t.Errorf("truncated: got %d objects, %v; want an error", count, it.Err())
+	}
+}
+
+func TestListObjectsV2LargeSize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<ListBucketResult><Contents><Key>snapshot</Key>" +
+			"<Size>21474836480</Size></Contents></ListBucketResult>"))
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	res, err := client.ListObjectsV2(context.Background(), "b", nil)
+	if err != nil {
+		t.Fatalf("ListObjectsV2: %s", err)
+	}
+	if len(res.Objects) != 1 || res.Objects[0].Size != 21474836480 {
+		t.Errorf("got %+v, want a 20GB object", res.Objects)
+	}
+}
@@ -0,0 +1,501 @@
+package cosclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-large-objects
+
+const (
+	MinPartSize     = int64(5 * 1024 * 1024)
+	DefaultPartSize = int64(16 * 1024 * 1024)
+	MaxParts        = 10000
+)
+
+// Part is a single part of an in-progress multipart upload, as returned
+// by ListParts.
+type Part struct {
+	PartNumber   int
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+// CompletedPart is what CompleteMultipartUpload needs to know about each
+// part that makes up the final object.
+type CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type initiateMultipartUploadResult struct {
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type listPartsResult struct {
+	Bucket               string
+	Key                  string
+	UploadId             string
+	PartNumberMarker     int
+	NextPartNumberMarker int
+	MaxParts             int
+	IsTruncated          bool
+	Part                 []Part
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []CompletedPart `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+// InitiateMultipartUpload starts a new multipart upload and returns its
+// upload ID.
+func (client *COSClient) InitiateMultipartUpload(ctx context.Context, bucket, key string, opts *PutObjectOptions) (string, error) {
+	// POST /bucket/file?uploads
+
+	if err := opts.validate(); err != nil {
+		return "", err
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?uploads", svcURL, bucket, key)
+
+	body, err := client.doHTTP(ctx, "POST", path, nil, 1, opts.headers())
+	if err != nil {
+		return "", fmt.Errorf("POST error(%s): %w", path, err)
+	}
+
+	result := initiateMultipartUploadResult{}
+	if err = xml.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("Error parsing result: %w", err)
+	}
+	if result.UploadId == "" {
+		return "", fmt.Errorf("Missing UploadId in result: %s", string(body))
+	}
+
+	return result.UploadId, nil
+}
+
+// UploadPart uploads one part of a multipart upload and returns its ETag.
+// Part numbers start at 1.
+func (client *COSClient) UploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, data io.Reader, size int64) (string, error) {
+	return client.uploadPart(ctx, bucket, key, uploadID, partNumber, data,
+		size, nil)
+}
+
+// UploadPartOptions are the optional settings for UploadPartWithOptions.
+type UploadPartOptions struct {
+	ContentMD5 string // Base64 encoded MD5 of the part
+
+	// SSECustomerKey must match the one used to initiate the upload
+	SSECustomerKey SSECustomerKey
+}
+
+// UploadPartWithOptions is UploadPart with optional settings, e.g. the
+// SSE-C key when the upload was initiated with one.
+func (client *COSClient) UploadPartWithOptions(ctx context.Context, bucket, key, uploadID string, partNumber int, data io.Reader, size int64, opts *UploadPartOptions) (string, error) {
+	headers := map[string]string{}
+	if opts != nil {
+		if err := opts.SSECustomerKey.validate(); err != nil {
+			return "", err
+		}
+		if opts.ContentMD5 != "" {
+			headers["Content-MD5"] = opts.ContentMD5
+		}
+		opts.SSECustomerKey.setHeaders(headers, false)
+	}
+	return client.uploadPart(ctx, bucket, key, uploadID, partNumber, data,
+		size, headers)
+}
+
+func (client *COSClient) uploadPart(ctx context.Context, bucket, key, uploadID string, partNumber int, data io.Reader, size int64, headers map[string]string) (string, error) {
+	// PUT /bucket/file?partNumber=1&uploadId=...
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?partNumber=%d&uploadId=%s", svcURL, bucket,
+		key, partNumber, url.QueryEscape(uploadID))
+
+	res, err := client.doStream(ctx, "PUT", path, data, size, 1, headers)
+	if err != nil {
+		return "", fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	return res.Header.Get("ETag"), nil
+}
+
+// CompleteMultipartUpload stitches the uploaded parts into the final
+// object. 'parts' does not need to be sorted.
+func (client *COSClient) CompleteMultipartUpload(ctx context.Context, bucket, key, uploadID string, parts []CompletedPart) (*UploadInfo, error) {
+	// POST /bucket/file?uploadId=...
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?uploadId=%s", svcURL, bucket, key,
+		url.QueryEscape(uploadID))
+
+	sorted := append([]CompletedPart{}, parts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].PartNumber < sorted[j].PartNumber
+	})
+
+	reqBody, err := xml.Marshal(completeMultipartUpload{Parts: sorted})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.doStream(ctx, "POST", path, bytes.NewReader(reqBody),
+		int64(len(reqBody)), 1, nil)
+	if err != nil {
+		return nil, fmt.Errorf("POST error(%s): %w", path, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// A 200 can still carry an <Error> if things went wrong after the
+	// server started sending its response
+	cosErr := &Error{StatusCode: http.StatusOK}
+	if parseError(body, cosErr) {
+		return nil, fmt.Errorf("POST error(%s): %w", path, cosErr)
+	}
+
+	result := completeMultipartUploadResult{}
+	if err = xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	return &UploadInfo{
+		Bucket:    bucket,
+		Key:       key,
+		ETag:      result.ETag,
+		Size:      -1,
+		VersionID: res.Header.Get("x-amz-version-id"),
+	}, nil
+}
+
+// AbortMultipartUpload cancels the upload and frees any parts already
+// stored.
+func (client *COSClient) AbortMultipartUpload(ctx context.Context, bucket, key, uploadID string) error {
+	// DELETE /bucket/file?uploadId=...
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?uploadId=%s", svcURL, bucket, key,
+		url.QueryEscape(uploadID))
+
+	_, err = client.doHTTP(ctx, "DELETE", path, nil, 1, nil)
+	if err != nil {
+		err = fmt.Errorf("DELETE error(%s): %w", path, err)
+	}
+	return err
+}
+
+// ListParts returns all of the parts uploaded so far for 'uploadID'.
+func (client *COSClient) ListParts(ctx context.Context, bucket, key, uploadID string) ([]Part, error) {
+	// GET /bucket/file?uploadId=...
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	res := []Part{}
+	marker := 0
+	for {
+		path := fmt.Sprintf("%s/%s/%s?uploadId=%s", svcURL, bucket, key,
+			url.QueryEscape(uploadID))
+		if marker != 0 {
+			path += fmt.Sprintf("&part-number-marker=%d", marker)
+		}
+
+		body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
+		if err != nil {
+			return nil, fmt.Errorf("GET error(%s): %w", path, err)
+		}
+
+		result := listPartsResult{}
+		if err = xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("Error parsing result: %w", err)
+		}
+		res = append(res, result.Part...)
+
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+
+	return res, nil
+}
+
+// MultipartUploader splits a stream into parts and uploads them in
+// parallel. Set UploadID to resume a previous upload, parts that have
+// already been uploaded and whose MD5 still matches are skipped. With
+// SSE-C the ETag isn't the MD5 so every part is uploaded again.
+type MultipartUploader struct {
+	Client      *COSClient
+	PartSize    int64 // Defaults to DefaultPartSize
+	Concurrency int   // Max # of parts in flight (and in memory)
+	MaxRetries  int   // Per part
+
+	// UploadID is set once the upload has been initiated so it can be
+	// saved and used to resume the upload later on
+	UploadID string
+
+	// LeavePartsOnError skips the abort on failure so the upload can be
+	// resumed
+	LeavePartsOnError bool
+}
+
+func (client *COSClient) NewMultipartUploader() *MultipartUploader {
+	return &MultipartUploader{
+		Client:      client,
+		PartSize:    DefaultPartSize,
+		Concurrency: 4,
+		MaxRetries:  3,
+	}
+}
+
+// Upload reads 'data' until EOF and uploads it as bucket/key.
+func (u *MultipartUploader) Upload(ctx context.Context, bucket, key string, data io.Reader, opts *PutObjectOptions) (*UploadInfo, error) {
+	partSize := u.PartSize
+	if partSize == 0 {
+		partSize = DefaultPartSize
+	}
+	if partSize < MinPartSize {
+		return nil, fmt.Errorf("PartSize must be at least %d", MinPartSize)
+	}
+	concurrency := u.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	sseKey := SSECustomerKey(nil)
+	if opts != nil {
+		sseKey = opts.SSECustomerKey
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Find the parts we already have if we're resuming
+	uploaded := map[int]Part{}
+	if u.UploadID == "" {
+		uploadID, err := u.Client.InitiateMultipartUpload(ctx, bucket, key, opts)
+		if err != nil {
+			return nil, err
+		}
+		u.UploadID = uploadID
+	} else {
+		parts, err := u.Client.ListParts(ctx, bucket, key, u.UploadID)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			uploaded[part.PartNumber] = part
+		}
+	}
+	Debug(2, "Multipart upload %s/%s: %s\n", bucket, key, u.UploadID)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var resErr error
+	completed := []CompletedPart{}
+	sem := make(chan struct{}, concurrency)
+
+	setErr := func(err error) {
+		mutex.Lock()
+		if resErr == nil {
+			resErr = err
+		}
+		mutex.Unlock()
+		cancel()
+	}
+
+	size := int64(0)
+	for partNumber := 1; ; partNumber++ {
+		if partNumber > MaxParts {
+			setErr(fmt.Errorf("Too many parts, increase PartSize"))
+			break
+		}
+
+		// Wait for a free slot before reading so that at most
+		// 'concurrency' parts are held in memory
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			setErr(ctx.Err())
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		buf := make([]byte, partSize)
+		n, err := io.ReadFull(data, buf)
+		if err == io.EOF && partNumber > 1 {
+			<-sem
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			<-sem
+			setErr(fmt.Errorf("Error reading part %d: %w", partNumber, err))
+			break
+		}
+		buf = buf[:n]
+		size += int64(n)
+		last := n < int(partSize)
+
+		// With SSE-C the ETag isn't the MD5 of the part so there's no way
+		// to tell if the saved part holds the same data, re-send it
+		sum := md5.Sum(buf)
+		if part, ok := uploaded[partNumber]; ok && sseKey == nil &&
+			part.Size == int64(n) &&
+			strings.Trim(part.ETag, `"`) == hex.EncodeToString(sum[:]) {
+
+			Debug(2, "Skipping part %d, already uploaded\n", partNumber)
+			mutex.Lock()
+			completed = append(completed, CompletedPart{partNumber, part.ETag})
+			mutex.Unlock()
+			<-sem
+		} else {
+			wg.Add(1)
+			go func(partNumber int, buf []byte, sum [md5.Size]byte) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				etag, err := u.uploadPart(ctx, bucket, key, partNumber, buf,
+					sum, sseKey)
+				if err != nil {
+					setErr(err)
+					return
+				}
+				mutex.Lock()
+				completed = append(completed, CompletedPart{partNumber, etag})
+				mutex.Unlock()
+			}(partNumber, buf, sum)
+		}
+
+		if last {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	var info *UploadInfo
+	if resErr == nil {
+		info, resErr = u.Client.CompleteMultipartUpload(ctx, bucket, key,
+			u.UploadID, completed)
+	}
+
+	if resErr != nil {
+		if !u.LeavePartsOnError {
+			// Use a fresh context since ours may be the reason we're here
+			abortCtx, abortCancel := context.WithTimeout(context.Background(),
+				time.Minute)
+			defer abortCancel()
+			if err := u.Client.AbortMultipartUpload(abortCtx, bucket, key,
+				u.UploadID); err != nil {
+				Debug(1, "Error aborting upload %s: %s\n", u.UploadID, err)
+			}
+			u.UploadID = ""
+		}
+		return nil, resErr
+	}
+
+	info.Size = size
+	return info, nil
+}
+
+// uploadPart sends one part, retrying it if it fails with a transient
+// error or an ETag mismatch, and makes sure the server saw the same bytes
+// we sent. With SSE-C the ETag isn't the MD5 so we rely on the server's
+// Content-MD5 check instead.
+func (u *MultipartUploader) uploadPart(ctx context.Context, bucket, key string, partNumber int, buf []byte, sum [md5.Size]byte, sseKey SSECustomerKey) (string, error) {
+	headers := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	sseKey.setHeaders(headers, false)
+	expected := hex.EncodeToString(sum[:])
+
+	// The retries are done here, using the client's backoff, rather than
+	// by each request so that a bad part isn't tried (MaxRetries+1) *
+	// MaxAttempts times
+	policy := u.Client.retryPolicy()
+	partCtx := withoutRetries(ctx)
+
+	var err error
+	for attempt := 0; attempt <= u.MaxRetries; attempt++ {
+		if attempt > 0 {
+			event := RetryEvent{
+				Method:  "PUT",
+				Path:    fmt.Sprintf("%s/%s part %d", bucket, key, partNumber),
+				Attempt: attempt,
+				Err:     err,
+				Delay:   policy.backoff(attempt, ""),
+			}
+			if err := policy.wait(ctx, event); err != nil {
+				return "", err
+			}
+		}
+
+		etag := ""
+		etag, err = u.Client.uploadPart(partCtx, bucket, key, u.UploadID,
+			partNumber, bytes.NewReader(buf), int64(len(buf)), headers)
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err == nil {
+			if sseKey != nil || strings.Trim(etag, `"`) == expected {
+				return etag, nil
+			}
+			err = fmt.Errorf("ETag mismatch on part %d: got %s, expected %q",
+				partNumber, etag, expected)
+		} else if !isRetryableErr(err) {
+			break
+		}
+	}
+
+	return "", fmt.Errorf("Error uploading part %d: %w", partNumber, err)
+}
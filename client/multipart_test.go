@@ -0,0 +1,116 @@
+package cosclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUploadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), int(2*MinPartSize+10))
+	sum := md5.Sum(data[:MinPartSize])
+	md5ETag := `"` + hex.EncodeToString(sum[:]) + `"`
+	// With SSE-C the ETag is something other than the MD5
+	sseETag := `"0f343b0931126a20f133d67c2b018a3b"`
+
+	tests := []struct {
+		name    string
+		sseKey  SSECustomerKey
+		etag    string
+		uploads int32
+	}{
+		{"md5 matches", nil, md5ETag, 1},
+		{"md5 mismatch", nil, sseETag, 3},
+		{"SSE-C", SSECustomerKey(bytes.Repeat([]byte("k"), 32)), sseETag, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			uploads := int32(0)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				switch {
+				case r.Method == "GET" && q.Get("uploadId") == "abc":
+					fmt.Fprintf(w, "<ListPartsResult>"+
+						"<Part><PartNumber>1</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>"+
+						"<Part><PartNumber>2</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>"+
+						"</ListPartsResult>", test.etag, MinPartSize, test.etag,
+						MinPartSize)
+				case r.Method == "PUT" && q.Get("partNumber") != "":
+					atomic.AddInt32(&uploads, 1)
+					buf, _ := ioutil.ReadAll(r.Body)
+					sum := md5.Sum(buf)
+					w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+				case r.Method == "POST" && q.Get("uploadId") == "abc":
+					fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>x-3</ETag></CompleteMultipartUploadResult>")
+				default:
+					t.Errorf("unexpected %s %s", r.Method, r.URL)
+					w.WriteHeader(http.StatusBadRequest)
+				}
+			}))
+			defer srv.Close()
+
+			client := newTestClient(t)
+			client.Endpoints = map[string]string{"b": srv.URL}
+
+			u := client.NewMultipartUploader()
+			u.PartSize = MinPartSize
+			u.UploadID = "abc"
+
+			_, err := u.Upload(context.Background(), "b", "k",
+				bytes.NewReader(data), &PutObjectOptions{SSECustomerKey: test.sseKey})
+			if err != nil {
+				t.Fatalf("Upload: %s", err)
+			}
+			if uploads != test.uploads {
+				t.Errorf("uploaded %d parts, want %d", uploads, test.uploads)
+			}
+		})
+	}
+}
+
+func TestUploadAbortOnCompleteError(t *testing.T) {
+	aborts := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch {
+		case r.Method == "POST" && r.URL.RawQuery == "uploads":
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>abc</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "PUT" && q.Get("partNumber") != "":
+			buf, _ := ioutil.ReadAll(r.Body)
+			sum := md5.Sum(buf)
+			w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+		case r.Method == "POST" && q.Get("uploadId") == "abc":
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+		case r.Method == "DELETE" && q.Get("uploadId") == "abc":
+			atomic.AddInt32(&aborts, 1)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t)
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	u := client.NewMultipartUploader()
+	_, err := u.Upload(context.Background(), "b", "k",
+		bytes.NewReader([]byte("data")), nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if aborts != 1 || u.UploadID != "" {
+		t.Errorf("aborts = %d, UploadID = %q, want 1 and none", aborts,
+			u.UploadID)
+	}
+}
@@ -0,0 +1,190 @@
+package cosclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option configures optional settings of a COSClient, see NewClient.
+type Option func(*clientOptions) error
+
+type clientOptions struct {
+	httpClient *http.Client
+	transport  http.RoundTripper
+	tlsConfig  *tls.Config // nil unless one of the TLS options was used
+
+	retryPolicy *RetryPolicy
+
+	accessKeyID     string
+	secretAccessKey string
+	region          string
+	auth            Authenticator
+	trustedProfile  *TrustedProfile
+	token           string
+	iamClientID     string
+	iamClientSecret string
+}
+
+// WithHTTPClient makes the COSClient send all of its requests (IAM, the
+// endpoints catalog and COS itself) through 'httpClient'.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(opts *clientOptions) error {
+		if httpClient == nil {
+			return fmt.Errorf("Missing HTTP client")
+		}
+		opts.httpClient = httpClient
+		return nil
+	}
+}
+
+// WithTransport uses 'rt' to send requests. If WithHTTPClient is also
+// used then 'rt' replaces that client's Transport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(opts *clientOptions) error {
+		if rt == nil {
+			return fmt.Errorf("Missing transport")
+		}
+		opts.transport = rt
+		return nil
+	}
+}
+
+func (opts *clientOptions) getTLSConfig() *tls.Config {
+	if opts.tlsConfig == nil {
+		opts.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return opts.tlsConfig
+}
+
+// WithCACertFile trusts the CA certificates in the PEM file at 'path' in
+// addition to the system's, e.g. for on-prem or private endpoints.
+func WithCACertFile(path string) Option {
+	return func(opts *clientOptions) error {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Error reading CA file: %w", err)
+		}
+		return WithCACertPEM(buf)(opts)
+	}
+}
+
+// WithCACertPEM trusts the PEM encoded CA certificates in 'buf' in
+// addition to the system's.
+func WithCACertPEM(buf []byte) Option {
+	return func(opts *clientOptions) error {
+		cfg := opts.getTLSConfig()
+		if cfg.RootCAs == nil {
+			pool, err := x509.SystemCertPool()
+			if err != nil || pool == nil {
+				pool = x509.NewCertPool()
+			}
+			cfg.RootCAs = pool
+		}
+		if !cfg.RootCAs.AppendCertsFromPEM(buf) {
+			return fmt.Errorf("No CA certificates found in PEM data")
+		}
+		return nil
+	}
+}
+
+// WithClientCertFile presents the certificate/key pair from the given PEM
+// files to the server for mutual TLS.
+func WithClientCertFile(certFile, keyFile string) Option {
+	return func(opts *clientOptions) error {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Error loading client certificate: %w", err)
+		}
+		return WithClientCert(cert)(opts)
+	}
+}
+
+// WithClientCert presents 'cert' to the server for mutual TLS.
+func WithClientCert(cert tls.Certificate) Option {
+	return func(opts *clientOptions) error {
+		cfg := opts.getTLSConfig()
+		cfg.Certificates = append(cfg.Certificates, cert)
+		return nil
+	}
+}
+
+// WithInsecureSkipVerify turns off verification of the server's
+// certificate. Only meant for testing.
+func WithInsecureSkipVerify() Option {
+	return func(opts *clientOptions) error {
+		log.Printf("WARNING: TLS certificate verification is disabled")
+		opts.getTLSConfig().InsecureSkipVerify = true
+		return nil
+	}
+}
+
+func (opts *clientOptions) buildHTTPClient() (*http.Client, error) {
+	if opts.tlsConfig != nil {
+		// Apply the TLS settings to whichever transport we'll be using
+		rt := opts.transport
+		if rt == nil && opts.httpClient != nil {
+			rt = opts.httpClient.Transport
+		}
+
+		var tr *http.Transport
+		if rt == nil {
+			tr = NewTransport()
+		} else if t, ok := rt.(*http.Transport); ok {
+			tr = t.Clone()
+		} else {
+			return nil, fmt.Errorf("TLS options require an *http.Transport")
+		}
+		tr.TLSClientConfig = opts.tlsConfig
+		opts.transport = tr
+	}
+
+	if opts.httpClient == nil && opts.transport == nil {
+		return defaultHTTPClient, nil
+	}
+
+	httpClient := &http.Client{}
+	if opts.httpClient != nil {
+		tmp := *opts.httpClient
+		httpClient = &tmp
+	}
+	if opts.transport != nil {
+		httpClient.Transport = opts.transport
+	}
+	return httpClient, nil
+}
+
+// NewTransport returns the pooled transport used by default, it's a good
+// starting point for callers that want to wrap or tweak it.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+// defaultHTTPClient is shared by all COSClients that don't have their own
+// so that connections are reused across them.
+var defaultHTTPClient = &http.Client{Transport: NewTransport()}
+
+func (client *COSClient) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return defaultHTTPClient
+}
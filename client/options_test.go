@@ -0,0 +1,133 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTLSOptions(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: srv.Certificate().Raw})
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"default verifies", nil, false},
+		{"CA PEM", []Option{WithCACertPEM(caPEM)}, true},
+		{"CA file", []Option{WithCACertFile(caFile)}, true},
+		{"insecure", []Option{WithInsecureSkipVerify()}, true},
+		{"TLS options on a custom transport", []Option{
+			WithTransport(http.DefaultTransport), WithCACertPEM(caPEM)}, true},
+	}
+
+	for _, test := range tests {
+		opts := append([]Option{WithRetryPolicy(NoRetries)}, test.opts...)
+		client := newTestClient(t, opts...)
+		_, err := client.doHTTP(context.Background(), "GET", srv.URL, nil, 1, nil)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v", test.name, err)
+		}
+	}
+
+	// The shared transport isn't touched by any of that
+	if tr := defaultHTTPClient.Transport.(*http.Transport); tr.TLSClientConfig.RootCAs != nil ||
+		tr.TLSClientConfig.InsecureSkipVerify {
+		t.Errorf("default transport was changed: %+v", tr.TLSClientConfig)
+	}
+
+	if _, err := NewClient("apikey", testInstanceID, WithCACertPEM([]byte("junk"))); err == nil {
+		t.Errorf("expected an error for a bad PEM")
+	}
+	if _, err := NewClient("apikey", testInstanceID,
+		WithTransport(roundTripperFunc(nil)), WithInsecureSkipVerify()); err == nil {
+		t.Errorf("expected an error for TLS options on a non *http.Transport")
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	peerCerts := int32(0)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.StoreInt32(&peerCerts, int32(len(r.TLS.PeerCertificates)))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE",
+		Bytes: srv.Certificate().Raw})
+
+	client := newTestClient(t, WithRetryPolicy(NoRetries), WithCACertPEM(caPEM))
+	if _, err := client.doHTTP(context.Background(), "GET", srv.URL, nil, 1, nil); err == nil {
+		t.Errorf("expected an error without a client certificate")
+	}
+
+	// Any cert will do for RequireAnyClientCert, use the server's
+	client = newTestClient(t, WithCACertPEM(caPEM),
+		WithClientCert(srv.TLS.Certificates[0]))
+	if _, err := client.doHTTP(context.Background(), "GET", srv.URL, nil, 1, nil); err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	if peerCerts != 1 {
+		t.Errorf("server saw %d client certificates, want 1", peerCerts)
+	}
+}
+
+func TestTransportShared(t *testing.T) {
+	client1 := newTestClient(t)
+	client2 := newTestClient(t)
+	if client1.httpClient() != defaultHTTPClient ||
+		client2.httpClient() != defaultHTTPClient {
+		t.Errorf("clients without options should share defaultHTTPClient")
+	}
+
+	conns := int32(0)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := newTestClient(t, WithInsecureSkipVerify())
+	for i := 0; i < 5; i++ {
+		if _, err := client.doHTTP(context.Background(), "GET", srv.URL, nil,
+			1, nil); err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+	}
+	if conns != 1 {
+		t.Errorf("server saw %d connections, want 1 reused one", conns)
+	}
+}
+
+// roundTripperFunc makes a func an http.RoundTripper.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
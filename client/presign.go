@@ -0,0 +1,74 @@
+package cosclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// PresignOptions constrain what a presigned URL can be used for. The
+// headers listed here are signed, so the request has to send exactly the
+// same values or COS will reject it.
+type PresignOptions struct {
+	ContentType string            // PUT: the Content-Type of the upload
+	Metadata    map[string]string // PUT: sent as x-amz-meta-<name>
+	VersionID   string            // GET: a specific version of the object
+}
+
+// PresignGetObject returns a URL that can be used, without any other
+// credentials, to download bucket/key for the next 'expiry' (max 7 days).
+// The client must have HMAC credentials, see WithHMAC.
+func (client *COSClient) PresignGetObject(bucket, key string, expiry time.Duration, opts *PresignOptions) (string, error) {
+	return client.PresignGetObjectWithContext(context.Background(), bucket,
+		key, expiry, opts)
+}
+
+func (client *COSClient) PresignGetObjectWithContext(ctx context.Context, bucket, key string, expiry time.Duration, opts *PresignOptions) (string, error) {
+	return client.presign(ctx, "GET", bucket, key, expiry, opts)
+}
+
+// PresignPutObject returns a URL that can be used, without any other
+// credentials, to upload bucket/key for the next 'expiry' (max 7 days).
+// The uploader must send the ContentType and Metadata from 'opts' as-is.
+func (client *COSClient) PresignPutObject(bucket, key string, expiry time.Duration, opts *PresignOptions) (string, error) {
+	return client.PresignPutObjectWithContext(context.Background(), bucket,
+		key, expiry, opts)
+}
+
+func (client *COSClient) PresignPutObjectWithContext(ctx context.Context, bucket, key string, expiry time.Duration, opts *PresignOptions) (string, error) {
+	return client.presign(ctx, "PUT", bucket, key, expiry, opts)
+}
+
+func (client *COSClient) presign(ctx context.Context, method, bucket, key string, expiry time.Duration, opts *PresignOptions) (string, error) {
+	if client.AccessKeyID == "" || client.SecretAccessKey == "" {
+		return "", fmt.Errorf("Presigned URLs require HMAC credentials")
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	u, err := url.Parse(svcURL)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing endpoint(%s): %w", svcURL, err)
+	}
+	u.Path = "/" + bucket + "/" + key
+
+	header := http.Header{}
+	if opts != nil {
+		if opts.ContentType != "" {
+			header.Set("Content-Type", opts.ContentType)
+		}
+		for k, v := range opts.Metadata {
+			header.Set("x-amz-meta-"+k, v)
+		}
+		if opts.VersionID != "" {
+			u.RawQuery = "versionId=" + url.QueryEscape(opts.VersionID)
+		}
+	}
+
+	return client.signer().Presign(method, u, header, expiry, time.Now())
+}
@@ -0,0 +1,103 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// Restore tiers, how quickly an archived object is made available.
+const (
+	RestoreTierBulk        = "Bulk"
+	RestoreTierStandard    = "Standard"
+	RestoreTierAccelerated = "Accelerated"
+)
+
+type restoreRequest struct {
+	XMLName              xml.Name `xml:"RestoreRequest"`
+	Days                 int      `xml:"Days"`
+	GlacierJobParameters struct {
+		Tier string `xml:"Tier"`
+	} `xml:"GlacierJobParameters"`
+}
+
+// RestoreObject starts restoring an archived object so that it can be
+// read for 'days' days. 'tier' is one of the RestoreTier constants, or
+// "" for the default. Use HeadObject, or WaitForRestore, to see when the
+// restore is done.
+func (client *COSClient) RestoreObject(ctx context.Context, bucket, key string, days int, tier string) error {
+	// POST /bucket/file?restore
+
+	if days < 1 {
+		return fmt.Errorf("Restore days must be at least 1")
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?restore", svcURL, bucket, key)
+
+	req := restoreRequest{Days: days}
+	req.GlacierJobParameters.Tier = tier
+	if tier == "" {
+		req.GlacierJobParameters.Tier = RestoreTierBulk
+	}
+
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(body)
+	headers := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+
+	// Asking for the same restore twice is harmless so this can be retried
+	_, err = client.doHTTP(withReplayable(ctx), "POST", path, body, 1, headers)
+	if err != nil {
+		err = fmt.Errorf("POST error(%s): %w", path, err)
+	}
+	return err
+}
+
+// WaitForRestore polls the object every 'interval' until its restore is
+// complete, or 'ctx' is done, and returns its final metadata. Objects that
+// were never archived are returned right away.
+func (client *COSClient) WaitForRestore(ctx context.Context, bucket, key string, interval time.Duration) (*ObjectInfo, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	for {
+		info, err := client.HeadObject(ctx, bucket, key)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.Restore == nil {
+			if info.Transition == "" &&
+				info.StorageClass != StorageClassArchive &&
+				info.StorageClass != StorageClassAcceleratedArchive {
+				return info, nil
+			}
+			return nil, fmt.Errorf("No restore requested for %s/%s", bucket, key)
+		}
+
+		if !info.Restore.OngoingRequest {
+			return info, nil
+		}
+
+		Debug(2, "Restore of %s/%s still in progress\n", bucket, key)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cosclient
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how requests that fail with a transient error
+// (network errors, 5xx, SlowDown...) are retried.
+type RetryPolicy struct {
+	MaxAttempts int           // Total # of tries, including the first one
+	BaseDelay   time.Duration // Delay before the first retry, doubles each time
+	MaxDelay    time.Duration // Upper limit on any one delay
+
+	// OnRetry, if set, is called just before waiting to retry a request
+	OnRetry func(RetryEvent)
+}
+
+// RetryEvent describes a failed attempt that's about to be retried.
+type RetryEvent struct {
+	Method     string
+	Path       string
+	Attempt    int // The attempt that failed, starting at 1
+	StatusCode int // Zero if there was no response
+	Err        error
+	Delay      time.Duration // How long we'll wait before the next attempt
+}
+
+// DefaultRetryPolicy is used by clients that don't set their own.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   200 * time.Millisecond,
+	MaxDelay:    20 * time.Second,
+}
+
+// NoRetries turns off retries.
+var NoRetries = RetryPolicy{MaxAttempts: 1}
+
+// WithRetryPolicy overrides DefaultRetryPolicy for the client.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(opts *clientOptions) error {
+		opts.retryPolicy = &policy
+		return nil
+	}
+}
+
+// retryPolicyFor returns the policy for a request made with 'ctx', which
+// is NoRetries if the caller is doing its own retries.
+func (client *COSClient) retryPolicyFor(ctx context.Context) *RetryPolicy {
+	if noRetries, _ := ctx.Value(noRetriesKey{}).(bool); noRetries {
+		return &NoRetries
+	}
+	return client.retryPolicy()
+}
+
+func (client *COSClient) retryPolicy() *RetryPolicy {
+	if client.RetryPolicy != nil {
+		return client.RetryPolicy
+	}
+	return &DefaultRetryPolicy
+}
+
+// backoff returns how long to wait after failed attempt # 'attempt'. A
+// Retry-After value from the server wins as long as it's not beyond
+// MaxDelay, otherwise it's exponential backoff with full jitter.
+func (policy *RetryPolicy) backoff(attempt int, retryAfter string) time.Duration {
+	if d, ok := parseRetryAfter(retryAfter); ok &&
+		(policy.MaxDelay <= 0 || d <= policy.MaxDelay) {
+		return d
+	}
+
+	delay := policy.BaseDelay
+	for i := 1; i < attempt && (policy.MaxDelay <= 0 || delay < policy.MaxDelay); i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
+
+// parseRetryAfter handles both the seconds and HTTP-date forms.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+// wait calls the OnRetry hook and then sleeps for the event's delay,
+// returning early if the context is done.
+func (policy *RetryPolicy) wait(ctx context.Context, event RetryEvent) error {
+	Debug(2, "Retrying %s %s (attempt %d) in %s: %s\n", event.Method,
+		event.Path, event.Attempt, event.Delay, event.Err)
+
+	if policy.OnRetry != nil {
+		policy.OnRetry(event)
+	}
+
+	timer := time.NewTimer(event.Delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryableStatus returns true for responses that indicate a transient
+// problem on the server side.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableErr returns true if a failed attempt is worth trying again,
+// using the same rule as doStream: network errors and transient COS
+// errors. Anything else, e.g. a 403 or a 412, will fail the same way.
+func isRetryableErr(err error) bool {
+	var cosErr *Error
+	if errors.As(err, &cosErr) {
+		return cosErr.retryable()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// isIdempotent returns true if sending the request more than once has the
+// same effect as sending it once.
+func isIdempotent(ctx context.Context, method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	replayable, _ := ctx.Value(replayableKey{}).(bool)
+	return replayable
+}
+
+type replayableKey struct{}
+
+// withReplayable marks requests made with the returned context as safe
+// to retry even though their method (i.e. POST) isn't idempotent.
+func withReplayable(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayableKey{}, true)
+}
+
+type noRetriesKey struct{}
+
+// withoutRetries makes requests made with the returned context be tried
+// only once, for callers (like the multipart uploader) that retry on their
+// own so that attempts don't multiply.
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetriesKey{}, true)
+}
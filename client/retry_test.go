@@ -0,0 +1,313 @@
+package cosclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		value string
+		ok    bool
+		min   time.Duration
+		max   time.Duration
+	}{
+		{"", false, 0, 0},
+		{"junk", false, 0, 0},
+		{"-1", false, 0, 0},
+		{"0", true, 0, 0},
+		{"3", true, 3 * time.Second, 3 * time.Second},
+		{future, true, 59 * time.Minute, time.Hour},
+		{past, true, 0, 0},
+	}
+
+	for _, test := range tests {
+		d, ok := parseRetryAfter(test.value)
+		if ok != test.ok || d < test.min || d > test.max {
+			t.Errorf("parseRetryAfter(%q) = %s, %v; want %v in [%s, %s]",
+				test.value, d, ok, test.ok, test.min, test.max)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts: 10,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}
+
+	tests := []struct {
+		attempt    int
+		retryAfter string
+		min        time.Duration
+		max        time.Duration
+	}{
+		{1, "", 1, 100 * time.Millisecond},
+		{2, "", 1, 200 * time.Millisecond},
+		{3, "", 1, 400 * time.Millisecond},
+		{8, "", 1, time.Second}, // Capped at MaxDelay
+		{1, "0", 0, 0},
+		{1, "1", time.Second, time.Second},
+		{1, "30", 1, 100 * time.Millisecond}, // Beyond MaxDelay, ignored
+	}
+
+	for _, test := range tests {
+		// Jitter makes it random so try a few times
+		for i := 0; i < 50; i++ {
+			d := policy.backoff(test.attempt, test.retryAfter)
+			if d < test.min || d > test.max {
+				t.Fatalf("backoff(%d, %q) = %s, want [%s, %s]", test.attempt,
+					test.retryAfter, d, test.min, test.max)
+			}
+		}
+	}
+
+	if d := (&RetryPolicy{}).backoff(3, ""); d != 0 {
+		t.Errorf("backoff with no BaseDelay = %s, want 0", d)
+	}
+}
+
+// failingServer returns 'status' and 'code' (with Retry-After: 0) for the
+// first 'failures' requests and then 200s.
+func failingServer(status int, code string, failures int32, count *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		if atomic.AddInt32(count, 1) <= failures {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(status)
+			fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestRetryAttempts(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		code     string
+		failures int32
+		attempts int32
+		fails    bool
+	}{
+		{"503 then ok", http.StatusServiceUnavailable, "ServiceUnavailable", 2, 3, false},
+		{"429 then ok", http.StatusTooManyRequests, "SlowDown", 1, 2, false},
+		{"always 503", http.StatusServiceUnavailable, "SlowDown", 100, 3, true},
+		{"400 isn't retried", http.StatusBadRequest, "InvalidArgument", 100, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count := int32(0)
+			srv := failingServer(test.status, test.code, test.failures, &count)
+			defer srv.Close()
+
+			events := []RetryEvent{}
+			client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+				MaxAttempts: 3,
+				BaseDelay:   time.Millisecond,
+				OnRetry:     func(e RetryEvent) { events = append(events, e) },
+			}))
+
+			_, err := client.doHTTP(context.Background(), "PUT", srv.URL+"/b/k",
+				[]byte("data"), 0, nil)
+			if (err != nil) != test.fails {
+				t.Fatalf("err = %v, want failure: %v", err, test.fails)
+			}
+			if count != test.attempts {
+				t.Errorf("attempts = %d, want %d", count, test.attempts)
+			}
+			if len(events) != int(test.attempts)-1 {
+				t.Fatalf("OnRetry called %d times, want %d", len(events),
+					test.attempts-1)
+			}
+			for i, e := range events {
+				if e.Attempt != i+1 || e.StatusCode != test.status ||
+					e.Delay != 0 {
+					t.Errorf("event %d: %+v", i, e)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryNotReplayable(t *testing.T) {
+	policy := WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+	})
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		body     func() io.Reader
+		attempts int32
+	}{
+		{"POST", context.Background(), "POST",
+			func() io.Reader { return bytes.NewReader([]byte("data")) }, 1},
+		{"replayable POST", withReplayable(context.Background()), "POST",
+			func() io.Reader { return bytes.NewReader([]byte("data")) }, 3},
+		{"unseekable PUT", context.Background(), "PUT",
+			func() io.Reader { return io.MultiReader(bytes.NewReader([]byte("data"))) }, 1},
+		{"withoutRetries", withoutRetries(context.Background()), "PUT",
+			func() io.Reader { return bytes.NewReader([]byte("data")) }, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count := int32(0)
+			srv := failingServer(http.StatusServiceUnavailable, "SlowDown", 100,
+				&count)
+			defer srv.Close()
+
+			client := newTestClient(t, policy)
+			_, err := client.doStream(test.ctx, test.method, srv.URL+"/b/k",
+				test.body(), 4, 0, nil)
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			if count != test.attempts {
+				t.Errorf("attempts = %d, want %d", count, test.attempts)
+			}
+		})
+	}
+}
+
+func TestRetryCancel(t *testing.T) {
+	count := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		MaxDelay:    time.Minute,
+		OnRetry:     func(RetryEvent) { cancel() },
+	}))
+
+	start := time.Now()
+	_, err := client.doHTTP(ctx, "GET", srv.URL+"/b/k", nil, 0, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s, the backoff sleep wasn't interrupted", elapsed)
+	}
+	if count != 1 {
+		t.Errorf("attempts = %d, want 1", count)
+	}
+}
+
+func TestPartRetriesDontMultiply(t *testing.T) {
+	gets := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("ETag", `"etag"`)
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("<Error><Code>SlowDown</Code></Error>"))
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Millisecond,
+	}))
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	d := client.NewMultipartDownloader()
+	d.MaxRetries = 2
+	_, err := d.Download(context.Background(), "b", "k", &bufferAt{})
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if gets != 3 {
+		t.Errorf("GETs = %d, want 3 (MaxRetries+1)", gets)
+	}
+}
+
+func TestPartRetriesOnlyTransient(t *testing.T) {
+	gets := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", "10")
+			w.Header().Set("ETag", `"etag"`)
+			return
+		}
+		// The object was replaced since the HEAD
+		atomic.AddInt32(&gets, 1)
+		w.WriteHeader(http.StatusPreconditionFailed)
+		w.Write([]byte("<Error><Code>PreconditionFailed</Code></Error>"))
+	}))
+	defer srv.Close()
+
+	client := newTestClient(t, WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 4,
+		BaseDelay:   time.Millisecond,
+	}))
+	client.Endpoints = map[string]string{"b": srv.URL}
+
+	d := client.NewMultipartDownloader()
+	d.MaxRetries = 2
+	_, err := d.Download(context.Background(), "b", "k", &bufferAt{})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Download: %v, want ErrPreconditionFailed", err)
+	}
+	if gets != 1 {
+		t.Errorf("GETs = %d, want 1", gets)
+	}
+}
+
+// bufferAt is an in-memory io.WriterAt, and io.ReaderAt so that downloads
+// can be verified. Like a file it's safe to write to in parallel.
+type bufferAt struct {
+	mutex sync.Mutex
+	buf   []byte
+}
+
+func (b *bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if end := int(off) + len(p); end > len(b.buf) {
+		b.buf = append(b.buf, make([]byte, end-len(b.buf))...)
+	}
+	return copy(b.buf[off:], p), nil
+}
+
+func (b *bufferAt) ReadAt(p []byte, off int64) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if off >= int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
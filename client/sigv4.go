@@ -0,0 +1,397 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+// https://cloud.ibm.com/docs/cloud-object-storage?topic=cloud-object-storage-hmac-signature
+
+// DefaultRegion is used in the SigV4 scope when the client's Region isn't
+// set. COS accepts it for every location.
+const DefaultRegion = "us-standard"
+
+const (
+	sigV4Algorithm   = "AWS4-HMAC-SHA256"
+	sigV4DateFormat  = "20060102T150405Z"
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	streamingChunkSize = 64 * 1024
+)
+
+// PayloadMode is how a Signer deals with request bodies.
+type PayloadMode int
+
+const (
+	// PayloadSigned hashes the body into the signature when it can be
+	// rewound (is an io.Seeker), which means reading it twice. Other
+	// bodies are sent unsigned.
+	PayloadSigned PayloadMode = iota
+
+	// PayloadUnsigned leaves the body out of the signature, TLS still
+	// protects it in transit.
+	PayloadUnsigned
+
+	// PayloadStreaming signs the body a chunk at a time as it's sent
+	// (aws-chunked) so it's only read once. Bodies of unknown size are
+	// sent unsigned.
+	PayloadStreaming
+)
+
+// WithHMAC gives the client HMAC credentials (an access key ID and secret
+// access key) so it can create presigned URLs. If no API key is given to
+// NewClient then all requests are signed with them too.
+func WithHMAC(accessKeyID, secretAccessKey string) Option {
+	return func(opts *clientOptions) error {
+		if accessKeyID == "" || secretAccessKey == "" {
+			return fmt.Errorf("Missing HMAC access key ID or secret")
+		}
+		opts.accessKeyID = accessKeyID
+		opts.secretAccessKey = secretAccessKey
+		return nil
+	}
+}
+
+// WithRegion sets the region used to sign requests, see DefaultRegion.
+func WithRegion(region string) Option {
+	return func(opts *clientOptions) error {
+		opts.region = region
+		return nil
+	}
+}
+
+// Signer signs requests with AWS Signature Version 4.
+type Signer struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	Region          string // Defaults to DefaultRegion
+	Service         string // Defaults to "s3"
+	Payload         PayloadMode
+}
+
+func (client *COSClient) signer() *Signer {
+	return &Signer{
+		AccessKeyID:     client.AccessKeyID,
+		SecretAccessKey: client.SecretAccessKey,
+		Region:          client.Region,
+	}
+}
+
+// scope returns the credential scope for 'now', e.g.
+// 20130524/us-east-1/s3/aws4_request
+func (s *Signer) scope(now time.Time) string {
+	region := s.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	service := s.Service
+	if service == "" {
+		service = "s3"
+	}
+	return now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// Presign returns 'u' with the query parameters that let anyone holding it
+// make the request until 'expiry' after 'now'. 'header' holds the headers,
+// other than Host, that the request must be sent with.
+func (s *Signer) Presign(method string, u *url.URL, header http.Header, expiry time.Duration, now time.Time) (string, error) {
+	if expiry < time.Second || expiry > 7*24*time.Hour {
+		return "", fmt.Errorf("Expiry must be between 1 second and 7 days")
+	}
+
+	now = now.UTC()
+	scope := s.scope(now)
+	names, canonHeaders := canonicalHeaders(u.Host, header)
+
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", s.AccessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.Format(sigV4DateFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", names)
+
+	canonReq := canonicalRequest(method, u, query, canonHeaders, names,
+		unsignedPayload)
+	query.Set("X-Amz-Signature", s.signature(now, scope, canonReq))
+
+	signed := *u
+	signed.RawPath = canonicalURI(u)
+	signed.RawQuery = canonicalQuery(query)
+	return signed.String(), nil
+}
+
+// Authenticate signs 'req' with an Authorization header, which makes a
+// Signer an Authenticator.
+func (s *Signer) Authenticate(ctx context.Context, req *http.Request, body io.Reader) error {
+	return s.sign(req, body, time.Now())
+}
+
+func (s *Signer) sign(req *http.Request, body io.Reader, now time.Time) error {
+	now = now.UTC()
+	scope := s.scope(now)
+
+	payload, err := s.payloadHash(req, body)
+	if err != nil {
+		return err
+	}
+	if payload == streamingPayload {
+		req.Header.Set("X-Amz-Decoded-Content-Length",
+			strconv.FormatInt(req.ContentLength, 10))
+		encoding := "aws-chunked"
+		if enc := req.Header.Get("Content-Encoding"); enc != "" {
+			encoding += "," + enc
+		}
+		req.Header.Set("Content-Encoding", encoding)
+		req.ContentLength = streamingSize(req.ContentLength, streamingChunkSize)
+	}
+	req.Header.Set("X-Amz-Date", now.Format(sigV4DateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	header := req.Header.Clone()
+	header.Del("Authorization")
+	header.Del("User-Agent")
+	names, canonHeaders := canonicalHeaders(host, header)
+
+	canonReq := canonicalRequest(req.Method, req.URL, req.URL.Query(),
+		canonHeaders, names, payload)
+	signature := s.signature(now, scope, canonReq)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.AccessKeyID, scope, names, signature))
+	Debug(2, "AUTH: %s %s/%s\n", sigV4Algorithm, s.AccessKeyID, scope)
+
+	if payload == streamingPayload {
+		req.Body = ioutil.NopCloser(&chunkSigner{
+			src:     req.Body,
+			key:     s.signingKey(scope),
+			prefix:  "AWS4-HMAC-SHA256-PAYLOAD\n" + now.Format(sigV4DateFormat) + "\n" + scope + "\n",
+			prevSig: signature,
+			chunk:   make([]byte, streamingChunkSize),
+		})
+	}
+	return nil
+}
+
+// payloadHash returns the X-Amz-Content-Sha256 value for the body.
+func (s *Signer) payloadHash(req *http.Request, body io.Reader) (string, error) {
+	if body == nil || req.ContentLength == 0 {
+		return emptySHA256, nil
+	}
+	if s.Payload == PayloadUnsigned {
+		return unsignedPayload, nil
+	}
+	if s.Payload == PayloadStreaming {
+		if req.ContentLength < 0 {
+			return unsignedPayload, nil
+		}
+		return streamingPayload, nil
+	}
+
+	seeker, ok := body.(io.ReadSeeker)
+	if !ok {
+		return unsignedPayload, nil
+	}
+	offset, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return unsignedPayload, nil
+	}
+
+	src := io.Reader(seeker)
+	if req.ContentLength > 0 {
+		src = io.LimitReader(seeker, req.ContentLength)
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(hash, src); err != nil {
+		return "", fmt.Errorf("Error hashing body: %w", err)
+	}
+	if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+		return "", fmt.Errorf("Error rewinding body: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// canonicalRequest joins the parts of the request that get signed.
+func canonicalRequest(method string, u *url.URL, query url.Values, canonHeaders, names, payload string) string {
+	return strings.Join([]string{
+		method,
+		canonicalURI(u),
+		canonicalQuery(query),
+		canonHeaders,
+		names,
+		payload,
+	}, "\n")
+}
+
+// signature signs the canonical request
+func (s *Signer) signature(now time.Time, scope string, canonReq string) string {
+	Debug(3, "Canonical request:\n%s\n", canonReq)
+
+	sum := sha256.Sum256([]byte(canonReq))
+	toSign := sigV4Algorithm + "\n" + now.Format(sigV4DateFormat) + "\n" +
+		scope + "\n" + hex.EncodeToString(sum[:])
+
+	return hex.EncodeToString(hmacSHA256(s.signingKey(scope), toSign))
+}
+
+// signingKey derives the key from the secret and the parts of the scope.
+func (s *Signer) signingKey(scope string) []byte {
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalURI is the URI-encoded path, which S3 doesn't normalize.
+func canonicalURI(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return uriEncode(u.Path, false)
+}
+
+// canonicalQuery returns the query sorted by name and then value.
+func canonicalQuery(query url.Values) string {
+	params := [][2]string{}
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, [2]string{uriEncode(k, true), uriEncode(v, true)})
+		}
+	}
+	// Sort on the name first, joining them with '=' and then sorting
+	// would put "a-b=" before "a="
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+
+	res := []string{}
+	for _, param := range params {
+		res = append(res, param[0]+"="+param[1])
+	}
+	return strings.Join(res, "&")
+}
+
+// canonicalHeaders returns the signed header names, ';' separated, and the
+// canonical headers block (each "name:value\n") for 'host' plus 'header'.
+func canonicalHeaders(host string, header http.Header) (string, string) {
+	values := map[string][]string{"host": {host}}
+	for k, v := range header {
+		k = strings.ToLower(k)
+		values[k] = append(values[k], v...)
+	}
+
+	names := []string{}
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canon := strings.Builder{}
+	for _, k := range names {
+		trimmed := []string{}
+		for _, v := range values[k] {
+			trimmed = append(trimmed, strings.Join(strings.Fields(v), " "))
+		}
+		canon.WriteString(k + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+	return strings.Join(names, ";"), canon.String()
+}
+
+// uriEncode encodes everything but the unreserved characters, and '/'
+// unless 'encodeSlash' is set, as SigV4 requires.
+func uriEncode(str string, encodeSlash bool) string {
+	res := strings.Builder{}
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' ||
+			c == '~' || (c == '/' && !encodeSlash) {
+			res.WriteByte(c)
+		} else {
+			fmt.Fprintf(&res, "%%%02X", c)
+		}
+	}
+	return res.String()
+}
+
+// streamingSize is the Content-Length of 'size' bytes once they're split
+// into signed chunks, including the final empty one.
+func streamingSize(size, chunkSize int64) int64 {
+	chunkLen := func(n int64) int64 {
+		// <hex size>;chunk-signature=<64 hex>\r\n<data>\r\n
+		return int64(len(strconv.FormatInt(n, 16))) + 17 + 64 + 2 + n + 2
+	}
+	res := (size / chunkSize) * chunkLen(chunkSize)
+	if size%chunkSize > 0 {
+		res += chunkLen(size % chunkSize)
+	}
+	return res + chunkLen(0)
+}
+
+// chunkSigner turns the body into aws-chunked encoding, each chunk signed
+// using the signature of the one before it.
+type chunkSigner struct {
+	src     io.Reader
+	key     []byte
+	prefix  string // Start of each chunk's string to sign
+	prevSig string
+	chunk   []byte
+	out     []byte
+	done    bool
+}
+
+func (c *chunkSigner) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(c.src, c.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		c.out = c.sign(c.chunk[:n])
+		c.done = n == 0
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+func (c *chunkSigner) sign(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	toSign := c.prefix + c.prevSig + "\n" + emptySHA256 + "\n" +
+		hex.EncodeToString(sum[:])
+	c.prevSig = hex.EncodeToString(hmacSHA256(c.key, toSign))
+
+	res := []byte(fmt.Sprintf("%x;chunk-signature=%s\r\n", len(data), c.prevSig))
+	res = append(res, data...)
+	return append(res, "\r\n"...)
+}
@@ -0,0 +1,177 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on object tags
+const (
+	MaxObjectTags     = 10
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+)
+
+// Tag is a single key/value pair as it appears in a <Tagging> document.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Tagging is the S3 <Tagging> document.
+type Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  struct {
+		Tag []Tag
+	}
+}
+
+// NewTagging converts 'tags' to a Tagging document, sorted by key.
+func NewTagging(tags map[string]string) *Tagging {
+	tagging := &Tagging{}
+	for k, v := range tags {
+		tagging.TagSet.Tag = append(tagging.TagSet.Tag, Tag{Key: k, Value: v})
+	}
+	sort.Slice(tagging.TagSet.Tag, func(i, j int) bool {
+		return tagging.TagSet.Tag[i].Key < tagging.TagSet.Tag[j].Key
+	})
+	return tagging
+}
+
+// Map returns the tags as a map.
+func (tagging *Tagging) Map() map[string]string {
+	tags := map[string]string{}
+	for _, tag := range tagging.TagSet.Tag {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+// ValidateTags checks 'tags' against the COS limits: at most 10 tags,
+// keys of 1-128 and values of 0-256 characters made up of letters,
+// digits, whitespace and + - = . _ : / @. Keys can't start with "aws:".
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxObjectTags {
+		return fmt.Errorf("%w: too many tags (%d), max is %d", ErrInvalidTag,
+			len(tags), MaxObjectTags)
+	}
+	for k, v := range tags {
+		if k == "" {
+			return fmt.Errorf("%w: empty key", ErrInvalidTag)
+		}
+		if utf8.RuneCountInString(k) > MaxTagKeyLength {
+			return fmt.Errorf("%w: key %q is longer than %d", ErrInvalidTag,
+				k, MaxTagKeyLength)
+		}
+		if utf8.RuneCountInString(v) > MaxTagValueLength {
+			return fmt.Errorf("%w: value of %q is longer than %d",
+				ErrInvalidTag, k, MaxTagValueLength)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("%w: key %q uses the reserved aws: prefix",
+				ErrInvalidTag, k)
+		}
+		if !validTagChars(k) {
+			return fmt.Errorf("%w: key %q has invalid characters",
+				ErrInvalidTag, k)
+		}
+		if !validTagChars(v) {
+			return fmt.Errorf("%w: value of %q has invalid characters",
+				ErrInvalidTag, k)
+		}
+	}
+	return nil
+}
+
+func validTagChars(str string) bool {
+	for _, r := range str {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsSpace(r) {
+			continue
+		}
+		if !strings.ContainsRune("+-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetObjectTagging returns the tags on bucket/key.
+func (client *COSClient) GetObjectTagging(ctx context.Context, bucket, key string) (map[string]string, error) {
+	// GET /bucket/file?tagging
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?tagging", svcURL, bucket, key)
+
+	body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	tagging := Tagging{}
+	if err = xml.Unmarshal(body, &tagging); err != nil {
+		return nil, fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	return tagging.Map(), nil
+}
+
+// PutObjectTagging replaces all of the tags on bucket/key with 'tags'.
+func (client *COSClient) PutObjectTagging(ctx context.Context, bucket, key string, tags map[string]string) error {
+	// PUT /bucket/file?tagging
+
+	if err := ValidateTags(tags); err != nil {
+		return err
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?tagging", svcURL, bucket, key)
+
+	body, err := xml.Marshal(NewTagging(tags))
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(body)
+	headers := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+
+	_, err = client.doHTTP(ctx, "PUT", path, body, 1, headers)
+	if err != nil {
+		err = fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	return err
+}
+
+// DeleteObjectTagging removes all of the tags from bucket/key.
+func (client *COSClient) DeleteObjectTagging(ctx context.Context, bucket, key string) error {
+	// DELETE /bucket/file?tagging
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s?tagging", svcURL, bucket, key)
+
+	_, err = client.doHTTP(ctx, "DELETE", path, nil, 1, nil)
+	if err != nil {
+		err = fmt.Errorf("DELETE error(%s): %w", path, err)
+	}
+	return err
+}
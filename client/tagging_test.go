@@ -0,0 +1,60 @@
+package cosclient
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestValidateTags(t *testing.T) {
+	tooMany := map[string]string{}
+	max := map[string]string{}
+	for i := 0; i < MaxObjectTags; i++ {
+		max[fmt.Sprintf("k%d", i)] = "v"
+		tooMany[fmt.Sprintf("k%d", i)] = "v"
+	}
+	tooMany["one-more"] = "v"
+
+	// Tags are a map so there's no way to pass duplicate keys, but keys
+	// are case-sensitive so these are two different tags
+	cases := map[string]string{"Env": "prod", "env": "prod"}
+
+	tests := []struct {
+		name  string
+		tags  map[string]string
+		valid bool
+	}{
+		{"nil", nil, true},
+		{"empty", map[string]string{}, true},
+		{"simple", map[string]string{"project": "cos", "env": ""}, true},
+		{"all the chars", map[string]string{"a+-=._:/@ 1": "Z+-=._:/@ 9"}, true},
+		{"unicode", map[string]string{"größe": "日本"}, true},
+		{"case", cases, true},
+		{"max tags", max, true},
+		{"too many tags", tooMany, false},
+		{"empty key", map[string]string{"": "v"}, false},
+		{"max key", map[string]string{strings.Repeat("k", MaxTagKeyLength): "v"}, true},
+		{"long key", map[string]string{strings.Repeat("k", MaxTagKeyLength+1): "v"}, false},
+		// Lengths are in characters, not bytes
+		{"max unicode key", map[string]string{strings.Repeat("é", MaxTagKeyLength): "v"}, true},
+		{"max value", map[string]string{"k": strings.Repeat("v", MaxTagValueLength)}, true},
+		{"long value", map[string]string{"k": strings.Repeat("v", MaxTagValueLength+1)}, false},
+		{"aws prefix", map[string]string{"aws:created": "v"}, false},
+		{"AWS prefix", map[string]string{"AWS:created": "v"}, false},
+		{"aws not prefix", map[string]string{"my-aws:key": "v"}, true},
+		{"bad key char", map[string]string{"a*b": "v"}, false},
+		{"bad value char", map[string]string{"k": "a&b"}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateTags(test.tags)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: ValidateTags() = %v, want valid: %v", test.name,
+				err, test.valid)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidTag) {
+			t.Errorf("%s: %q doesn't match ErrInvalidTag", test.name, err)
+		}
+	}
+}
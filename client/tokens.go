@@ -0,0 +1,284 @@
+package cosclient
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// Once the token is within refreshTime of expiring a new one is fetched in
+// the background, but if it's within minTokenLife callers wait for it.
+var refreshTime = time.Minute * 5
+var minTokenLife = time.Minute
+
+// tokenTimeout limits a refresh since it's not tied to any one caller.
+var tokenTimeout = 2 * time.Minute
+
+// tokenManager is the client's IAM token state, other than Token and
+// Expires themselves. It's guarded by the client's RefreshMutex.
+type tokenManager struct {
+	refreshToken string        // From IAM, used for the next refresh
+	inflight     *tokenRefresh // The refresh in progress, if any
+	timer        *time.Timer   // Starts the next background refresh
+	closed       bool          // No more background refreshes
+}
+
+// tokenRefresh is a single refresh that any number of callers can wait on.
+type tokenRefresh struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// GetToken returns a valid IAM token, getting a new one first if needed.
+// It's safe to call concurrently, callers that need a new token at the
+// same time share a single request to IAM. Once there's a token a new one
+// is fetched in the background refreshTime before it expires, even if the
+// client is idle, see Close.
+func (client *COSClient) GetToken(ctx context.Context) (string, error) {
+	client.RefreshMutex.Lock()
+	token, expires := client.Token, client.Expires
+
+	if !client.canRefresh() {
+		// Someone gave us the token, we have no way to get another one
+		client.RefreshMutex.Unlock()
+		if token == "" {
+			return "", fmt.Errorf("No IAM token and no API key to get one")
+		}
+		return token, nil
+	}
+
+	now := time.Now()
+	if token != "" && now.Add(refreshTime).Before(expires) {
+		client.RefreshMutex.Unlock()
+		return token, nil
+	}
+
+	call := client.startRefresh()
+	if token != "" && now.Add(minTokenLife).Before(expires) {
+		// Still good for a while, let the refresh happen in the background
+		client.RefreshMutex.Unlock()
+		return token, nil
+	}
+	client.RefreshMutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// WithToken gives the client an IAM token to send, e.g. one from another
+// service. It's only used when there's no API key or trusted profile to
+// get one from IAM, nor HMAC keys to sign with. It can't be refreshed so
+// requests fail once it expires.
+func WithToken(token string) Option {
+	return func(opts *clientOptions) error {
+		if token == "" {
+			return fmt.Errorf("Missing token")
+		}
+		opts.token = token
+		return nil
+	}
+}
+
+// WithIAMClient gets tokens as the IAM (OAuth) client 'id'. IAM only
+// returns a usable refresh_token for, and only accepts one back from, a
+// token request made by a client. Without one the API key is sent each
+// time a new token is needed.
+func WithIAMClient(id, secret string) Option {
+	return func(opts *clientOptions) error {
+		if id == "" {
+			return fmt.Errorf("Missing IAM client ID")
+		}
+		opts.iamClientID = id
+		opts.iamClientSecret = secret
+		return nil
+	}
+}
+
+// Close stops the background token refreshes. The client can still be
+// used, tokens are then only fetched when they're needed.
+func (client *COSClient) Close() {
+	client.RefreshMutex.Lock()
+	defer client.RefreshMutex.Unlock()
+	client.tokens.closed = true
+	if client.tokens.timer != nil {
+		client.tokens.timer.Stop()
+		client.tokens.timer = nil
+	}
+}
+
+func (client *COSClient) Refresh() error {
+	return client.RefreshWithContext(context.Background())
+}
+
+// RefreshWithContext makes sure the client has a valid token, see GetToken.
+func (client *COSClient) RefreshWithContext(ctx context.Context) error {
+	_, err := client.GetToken(ctx)
+	return err
+}
+
+// startRefresh returns the refresh in progress, starting one if there
+// isn't one. RefreshMutex must be held.
+func (client *COSClient) startRefresh() *tokenRefresh {
+	if client.tokens.inflight != nil {
+		return client.tokens.inflight
+	}
+
+	call := &tokenRefresh{done: make(chan struct{})}
+	client.tokens.inflight = call
+
+	go func() {
+		// Not the caller's context since others may be waiting on this too
+		ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+		defer cancel()
+
+		token, err := client.fetchToken(ctx)
+		if err != nil {
+			Debug(1, "Error refreshing COS token: %s\n", err)
+		}
+
+		client.RefreshMutex.Lock()
+		call.token, call.err = token, err
+		client.tokens.inflight = nil
+		client.RefreshMutex.Unlock()
+		close(call.done)
+	}()
+
+	return call
+}
+
+// fetchToken gets a new token from IAM and saves it. With an IAM client
+// it uses the refresh token from the last one if there is one, falling
+// back to the API key (or trusted profile) if that fails.
+func (client *COSClient) fetchToken(ctx context.Context) (string, error) {
+	log.Printf("Refreshing COS token")
+
+	client.RefreshMutex.Lock()
+	refreshToken := client.tokens.refreshToken
+	client.RefreshMutex.Unlock()
+
+	headers := client.iamClientHeaders()
+
+	if refreshToken != "" && headers != nil {
+		bodyStr := "grant_type=refresh_token&refresh_token=" +
+			url.QueryEscape(refreshToken)
+		token, err := client.postToken(ctx, bodyStr, headers)
+		if err == nil {
+			return token, nil
+		}
+		Debug(2, "Refresh token failed, using the original grant: %s\n", err)
+	}
+
+	bodyStr, err := client.iamGrant()
+	if err != nil {
+		return "", err
+	}
+	if client.TrustedProfile != nil {
+		// Not a grant an IAM client can use, so there's no refresh token
+		headers = nil
+	}
+	return client.postToken(ctx, bodyStr, headers)
+}
+
+// iamClientHeaders returns the Basic auth of the IAM client, or nil if
+// there isn't one.
+func (client *COSClient) iamClientHeaders() map[string]string {
+	if client.IAMClientID == "" {
+		return nil
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(client.IAMClientID +
+		":" + client.IAMClientSecret))
+	return map[string]string{"Authorization": "Basic " + auth}
+}
+
+// postToken sends the grant to IAM and saves the token from the response.
+func (client *COSClient) postToken(ctx context.Context, bodyStr string, headers map[string]string) (string, error) {
+	body, err := client.postIAM(ctx, bodyStr, headers)
+	if err != nil {
+		return "", err
+	}
+
+	data := struct {
+		Access_token  string
+		Expiration    int64
+		Expires_in    int
+		Refresh_token string
+		Scope         string
+		Token_type    string
+		// or...
+		ErrorMessage string
+	}{}
+
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return "", fmt.Errorf("Error parsing response: %s\n%s",
+			err, string(body))
+	}
+
+	if data.ErrorMessage != "" {
+		return "", fmt.Errorf("IAM: %s", data.ErrorMessage)
+	}
+	if data.Access_token == "" {
+		return "", fmt.Errorf("IAM: response has no access_token")
+	}
+
+	expires := time.Unix(data.Expiration, 0)
+	if data.Expiration == 0 {
+		expires = time.Now().Add(time.Duration(data.Expires_in) * time.Second)
+	}
+
+	refreshToken := data.Refresh_token
+	if refreshToken == "not_supported" {
+		refreshToken = ""
+	}
+
+	client.RefreshMutex.Lock()
+	client.Token = data.Access_token
+	client.Expires = expires
+	client.tokens.refreshToken = refreshToken
+	client.scheduleRefresh(expires)
+	client.RefreshMutex.Unlock()
+
+	return data.Access_token, nil
+}
+
+// scheduleRefresh starts a background refresh refreshTime before
+// 'expires'. Tokens that don't live that long are left to GetToken, so a
+// short lived token doesn't turn into a loop of requests to IAM.
+// RefreshMutex must be held.
+func (client *COSClient) scheduleRefresh(expires time.Time) {
+	if client.tokens.closed {
+		return
+	}
+	if client.tokens.timer != nil {
+		client.tokens.timer.Stop()
+		client.tokens.timer = nil
+	}
+
+	delay := time.Until(expires.Add(-refreshTime))
+	if delay <= 0 {
+		return
+	}
+	client.tokens.timer = time.AfterFunc(delay, func() {
+		client.RefreshMutex.Lock()
+		if !client.tokens.closed {
+			client.startRefresh()
+		}
+		client.RefreshMutex.Unlock()
+	})
+}
+
+// expireToken forces the next GetToken() to get a new token.
+func (client *COSClient) expireToken() {
+	client.RefreshMutex.Lock()
+	client.Expires = time.Time{}
+	client.RefreshMutex.Unlock()
+}
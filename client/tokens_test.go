@@ -0,0 +1,280 @@
+package cosclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeIAM hands out "token1", "token2"... each good for an hour.
+type fakeIAM struct {
+	*httptest.Server
+	posts        int32
+	refreshToken string // Returned with each token
+	fail         int32  // Non-zero makes requests fail
+
+	mutex  sync.Mutex
+	grants []string // grant_type of each request
+	auths  []string // Authorization of each request
+}
+
+func newFakeIAM(t *testing.T) *fakeIAM {
+	iam := &fakeIAM{refreshToken: "not_supported"}
+	iam.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		n := atomic.AddInt32(&iam.posts, 1)
+
+		iam.mutex.Lock()
+		iam.grants = append(iam.grants, r.Form.Get("grant_type"))
+		iam.auths = append(iam.auths, r.Header.Get("Authorization"))
+		iam.mutex.Unlock()
+
+		if atomic.LoadInt32(&iam.fail) != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errorCode":"BXNIM0415E","errorMessage":"Provided API key could not be found."}`)
+			return
+		}
+
+		// Give concurrent callers a chance to pile up
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"token%d","refresh_token":%q,"expiration":%d}`,
+			n, iam.refreshToken, time.Now().Add(time.Hour).Unix())
+	}))
+	t.Cleanup(iam.Close)
+	return iam
+}
+
+func newIAMClient(t *testing.T, iam *fakeIAM) *COSClient {
+	t.Helper()
+	client, err := NewClient("apikey", testInstanceID,
+		WithRetryPolicy(NoRetries))
+	if err != nil {
+		t.Fatalf("NewClient: %s", err)
+	}
+	client.IAMEndpoint = iam.URL
+	return client
+}
+
+func TestGetTokenSingleFlight(t *testing.T) {
+	iam := newFakeIAM(t)
+	client := newIAMClient(t, iam)
+
+	const callers = 50
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = client.GetToken(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	if iam.posts != 1 {
+		t.Errorf("IAM got %d requests, want 1", iam.posts)
+	}
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "token1" {
+			t.Errorf("caller %d got %q, %v", i, tokens[i], errs[i])
+		}
+	}
+
+	// And it's cached from now on
+	if token, err := client.GetToken(context.Background()); token != "token1" ||
+		err != nil || iam.posts != 1 {
+		t.Errorf("GetToken() = %q, %v after %d requests", token, err, iam.posts)
+	}
+}
+
+func TestGetTokenBackground(t *testing.T) {
+	iam := newFakeIAM(t)
+	client := newIAMClient(t, iam)
+
+	if _, err := client.GetToken(context.Background()); err != nil {
+		t.Fatalf("GetToken: %s", err)
+	}
+
+	// Close to refreshTime the old token is still returned while a new one
+	// is fetched in the background
+	client.RefreshMutex.Lock()
+	client.Expires = time.Now().Add(refreshTime - time.Second)
+	client.RefreshMutex.Unlock()
+
+	token, err := client.GetToken(context.Background())
+	if token != "token1" || err != nil {
+		t.Fatalf("GetToken() = %q, %v, want the old token", token, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for token == "token1" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		token, err = client.GetToken(context.Background())
+	}
+	if token != "token2" || err != nil {
+		t.Errorf("GetToken() = %q, %v, want token2", token, err)
+	}
+	if iam.posts != 2 {
+		t.Errorf("IAM got %d requests, want 2", iam.posts)
+	}
+}
+
+func TestGetTokenTimer(t *testing.T) {
+	iam := newFakeIAM(t)
+	client := newIAMClient(t, iam)
+
+	// Tokens last an hour (to the second), have the timer go off soon
+	saved := refreshTime
+	refreshTime = time.Hour - 2*time.Second
+	defer func() { refreshTime = saved }()
+	defer client.Close()
+
+	if _, err := client.GetToken(context.Background()); err != nil {
+		t.Fatalf("GetToken: %s", err)
+	}
+
+	// No calls to GetToken, it has to happen on its own
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&iam.posts) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if posts := atomic.LoadInt32(&iam.posts); posts < 2 {
+		t.Fatalf("IAM got %d requests, want a background refresh", posts)
+	}
+
+	// Nothing more once it's closed
+	client.Close()
+	client.RefreshMutex.Lock()
+	inflight := client.tokens.inflight
+	client.RefreshMutex.Unlock()
+	if inflight != nil {
+		<-inflight.done
+	}
+	posts := atomic.LoadInt32(&iam.posts)
+	time.Sleep(200 * time.Millisecond)
+	if got := atomic.LoadInt32(&iam.posts); got != posts {
+		t.Errorf("IAM got %d requests after Close, want %d", got, posts)
+	}
+}
+
+func TestGetTokenRefreshToken(t *testing.T) {
+	clientAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("id:secret"))
+
+	tests := []struct {
+		refreshToken string
+		iamClient    bool
+		grant        string // Of the 2nd request
+		auth         string // Of every request
+	}{
+		{"not_supported", true, "urn:ibm:params:oauth:grant-type:apikey", clientAuth},
+		{"", true, "urn:ibm:params:oauth:grant-type:apikey", clientAuth},
+		{"real-refresh-token", true, "refresh_token", clientAuth},
+		// Without an IAM client there's no Authorization, nor refresh
+		{"real-refresh-token", false, "urn:ibm:params:oauth:grant-type:apikey", ""},
+	}
+
+	for _, test := range tests {
+		iam := newFakeIAM(t)
+		iam.refreshToken = test.refreshToken
+		client := newIAMClient(t, iam)
+		if test.iamClient {
+			client.IAMClientID, client.IAMClientSecret = "id", "secret"
+		}
+
+		client.GetToken(context.Background())
+		client.expireToken()
+		if token, err := client.GetToken(context.Background()); token != "token2" ||
+			err != nil {
+			t.Fatalf("%q: GetToken() = %q, %v", test.refreshToken, token, err)
+		}
+
+		if iam.posts != 2 || iam.grants[1] != test.grant {
+			t.Errorf("%q: grants = %q, want a 2nd %q", test.refreshToken,
+				iam.grants, test.grant)
+		}
+		for i, auth := range iam.auths {
+			if auth != test.auth {
+				t.Errorf("%q: request %d Authorization = %q, want %q",
+					test.refreshToken, i, auth, test.auth)
+			}
+		}
+	}
+}
+
+func TestGetTokenError(t *testing.T) {
+	iam := newFakeIAM(t)
+	atomic.StoreInt32(&iam.fail, 1)
+	client := newIAMClient(t, iam)
+
+	cosRequests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&cosRequests, 1)
+	}))
+	defer srv.Close()
+
+	_, err := client.doHTTP(context.Background(), "GET", srv.URL+"/b/k", nil,
+		1, nil)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	if cosRequests != 0 {
+		t.Errorf("sent %d requests without a token", cosRequests)
+	}
+}
+
+func TestTokenExpiredAfter401(t *testing.T) {
+	tests := []struct {
+		method string
+		body   string
+	}{
+		{"GET", ""},
+		{"PUT", "some data"}, // The body has to be sent again
+		{"POST", ""},         // Not idempotent, but a 401 wasn't run
+	}
+
+	for _, test := range tests {
+		iam := newFakeIAM(t)
+		client := newIAMClient(t, iam)
+
+		auths := []string{}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf, _ := ioutil.ReadAll(r.Body)
+			auth := r.Header.Get("Authorization")
+			auths = append(auths, auth)
+			if auth != "Bearer token2" {
+				// e.g. token1 was revoked
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if string(buf) != test.body {
+				t.Errorf("%s: body = %q, want %q", test.method, buf, test.body)
+			}
+			w.Write([]byte("ok"))
+		}))
+		defer srv.Close()
+
+		res, err := client.doStream(context.Background(), test.method,
+			srv.URL+"/b/k", strings.NewReader(test.body),
+			int64(len(test.body)), 1, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.method, err)
+		}
+		res.Body.Close()
+		if iam.posts != 2 {
+			t.Errorf("%s: IAM got %d requests, want 2", test.method, iam.posts)
+		}
+		if len(auths) != 2 || auths[0] != "Bearer token1" {
+			t.Errorf("%s: COS saw %q", test.method, auths)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package cosclient
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ObjectVersion is one version of an object in a versioned bucket.
+type ObjectVersion struct {
+	ObjectMetadata
+	VersionID string `xml:"VersionId"`
+	IsLatest  bool
+}
+
+// DeleteMarker is the placeholder left behind when an object in a
+// versioned bucket is deleted without a version ID.
+type DeleteMarker struct {
+	Key          string
+	VersionID    string `xml:"VersionId"`
+	IsLatest     bool
+	LastModified string
+	Owner        *Owner
+}
+
+// ListObjectVersionsOptions holds the optional settings for
+// ListObjectVersions.
+type ListObjectVersionsOptions struct {
+	Prefix          string
+	Delimiter       string
+	KeyMarker       string // From NextKeyMarker of the previous page
+	VersionIDMarker string // From NextVersionIDMarker of the previous page
+	MaxKeys         int
+	EncodingType    string // See ListObjectsOptions
+}
+
+// ListObjectVersionsResult is one page of a ListObjectVersions call.
+type ListObjectVersionsResult struct {
+	Name                string
+	Prefix              string
+	Delimiter           string
+	KeyMarker           string
+	VersionIDMarker     string `xml:"VersionIdMarker"`
+	NextKeyMarker       string
+	NextVersionIDMarker string `xml:"NextVersionIdMarker"`
+	MaxKeys             int
+	EncodingType        string
+	IsTruncated         bool
+
+	Versions       []ObjectVersion `xml:"Version"`
+	DeleteMarkers  []DeleteMarker  `xml:"DeleteMarker"`
+	CommonPrefixes []string        `xml:"CommonPrefixes>Prefix"`
+}
+
+// ListObjectVersions returns one page of the object versions, and delete
+// markers, in 'bucket'. To get the next page pass NextKeyMarker and
+// NextVersionIDMarker back in as KeyMarker and VersionIDMarker.
+func (client *COSClient) ListObjectVersions(ctx context.Context, bucket string, opts *ListObjectVersionsOptions) (*ListObjectVersionsResult, error) {
+	// GET /bucket?versions
+
+	if opts == nil {
+		opts = &ListObjectVersionsOptions{}
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Delimiter != "" {
+		query.Set("delimiter", opts.Delimiter)
+	}
+	if opts.KeyMarker != "" {
+		query.Set("key-marker", opts.KeyMarker)
+	}
+	if opts.VersionIDMarker != "" {
+		query.Set("version-id-marker", opts.VersionIDMarker)
+	}
+	if opts.MaxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(opts.MaxKeys))
+	}
+	if opts.EncodingType != "" {
+		query.Set("encoding-type", opts.EncodingType)
+	}
+
+	path := fmt.Sprintf("%s/%s?versions", svcURL, bucket)
+	if len(query) > 0 {
+		path += "&" + query.Encode()
+	}
+
+	body, err := client.doHTTP(ctx, "GET", path, nil, 2, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	res := &ListObjectVersionsResult{}
+	if err = xml.Unmarshal(body, res); err != nil {
+		return nil, fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	if res.EncodingType == "url" {
+		decode := func(str *string) {
+			if tmp, err := url.QueryUnescape(*str); err == nil {
+				*str = tmp
+			}
+		}
+		decode(&res.Prefix)
+		decode(&res.Delimiter)
+		decode(&res.KeyMarker)
+		decode(&res.NextKeyMarker)
+		for i := range res.Versions {
+			decode(&res.Versions[i].Key)
+		}
+		for i := range res.DeleteMarkers {
+			decode(&res.DeleteMarkers[i].Key)
+		}
+		for i := range res.CommonPrefixes {
+			decode(&res.CommonPrefixes[i])
+		}
+	}
+
+	return res, nil
+}
+
+// Bucket versioning states. A bucket that never had versioning turned on
+// has no state at all ("").
+const (
+	VersioningEnabled   = "Enabled"
+	VersioningSuspended = "Suspended"
+)
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"VersioningConfiguration"`
+	Status  string   `xml:",omitempty"`
+}
+
+// GetBucketVersioning returns the bucket's versioning state, one of
+// VersioningEnabled, VersioningSuspended or "" if it was never enabled.
+func (client *COSClient) GetBucketVersioning(ctx context.Context, bucket string) (string, error) {
+	// GET /bucket?versioning
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s?versioning", svcURL, bucket)
+
+	body, err := client.doHTTP(ctx, "GET", path, nil, 1, nil)
+	if err != nil {
+		return "", fmt.Errorf("GET error(%s): %w", path, err)
+	}
+
+	config := versioningConfiguration{}
+	if err = xml.Unmarshal(body, &config); err != nil {
+		return "", fmt.Errorf("Error parsing result: %w", err)
+	}
+
+	return config.Status, nil
+}
+
+// PutBucketVersioning sets the bucket's versioning state to either
+// VersioningEnabled or VersioningSuspended.
+func (client *COSClient) PutBucketVersioning(ctx context.Context, bucket, status string) error {
+	// PUT /bucket?versioning
+
+	if status != VersioningEnabled && status != VersioningSuspended {
+		return fmt.Errorf("Invalid versioning status %q (can be: %s,%s)",
+			status, VersioningEnabled, VersioningSuspended)
+	}
+
+	svcURL, err := client.GetEndpointForBucketWithContext(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("Getting getting endpoint(%s): %w", bucket, err)
+	}
+
+	path := fmt.Sprintf("%s/%s?versioning", svcURL, bucket)
+
+	body, err := xml.Marshal(versioningConfiguration{Status: status})
+	if err != nil {
+		return err
+	}
+
+	sum := md5.Sum(body)
+	headers := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+
+	_, err = client.doHTTP(ctx, "PUT", path, body, 1, headers)
+	if err != nil {
+		err = fmt.Errorf("PUT error(%s): %w", path, err)
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -9,12 +10,14 @@ import (
 )
 
 func main() {
-	apikey := "..."
 	// iam_endpoint := "https://iam.test.cloud.ibm.com/identity/token"
 	// endpoint := "https://s3.us-west.cloud-object-storage.test.appdomain.cloud"
 	res_id := "crn:v1:bluemix:public:cloud-object-storage:global:a/7f9dc5344476457f2c0f53244a246d44:c7f1202e-d7a3-4b92-8ce4-db0b3b372915::"
 
-	cos, err := cosclient.NewClient(apikey, res_id)
+	// The API key (or HMAC keys) come from IBMCLOUD_API_KEY/COS_HMAC_*,
+	// ~/.bluemix/cos_credentials or a trusted profile, in that order
+	cos, err := cosclient.NewClientWithCredentials(context.Background(),
+		cosclient.DefaultCredentialsChain(), res_id)
 	if err != nil {
 		fmt.Printf("%s\n", err)
 		os.Exit(1)